@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rovarghe/mule/plugin"
+	"github.com/rovarghe/mule/schema"
+)
+
+type (
+	// AdminHandler is an http.Handler for operating the modules loaded by LoadModules.
+	// It should only be reachable by operators, e.g. served on its own port bound to localhost.
+	// Every request must carry the token, as "Authorization: Bearer <token>". Browsers cannot
+	// send the header with a cross-origin form or simple request, so a web page cannot have
+	// an operator's browser restart modules.
+	//
+	//	GET  /modules               lists the loaded modules
+	//	POST /modules/{id}/restart  restarts a module and its dependents, see RestartModule
+	AdminHandler struct {
+		ctx   context.Context
+		token string
+	}
+
+	// moduleStatus describes a loaded module in the listing of AdminHandler
+	moduleStatus struct {
+		ID      plugin.ID      `json:"id"`
+		Version plugin.Version `json:"version"`
+		State   string         `json:"state"`
+	}
+)
+
+// NewAdminHandler returns an AdminHandler for the modules loaded into ctx by LoadModules,
+// accepting requests that carry the token
+func NewAdminHandler(ctx context.Context, token string) *AdminHandler {
+	if _, ok := ctx.Value(moduleCtxKey).(moduleLoadingContext); !ok {
+		panic("NewAdminHandler called without a module loading context, call LoadModules first")
+	}
+	if token == "" {
+		panic("NewAdminHandler called without a token")
+	}
+	return &AdminHandler{ctx: ctx, token: token}
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusUnauthorized})
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "modules":
+		if r.Method != http.MethodGet {
+			writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusMethodNotAllowed})
+			return
+		}
+		h.list(w)
+	case len(parts) == 3 && parts[0] == "modules" && parts[2] == "restart":
+		if r.Method != http.MethodPost {
+			writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusMethodNotAllowed})
+			return
+		}
+		h.restart(w, plugin.ID(parts[1]))
+	default:
+		writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusNotFound})
+	}
+}
+
+// authorized is true if the request carries the token
+func (h *AdminHandler) authorized(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *AdminHandler) list(w http.ResponseWriter) {
+	mCtx, err := loadedModules(h.ctx)
+	if err != nil {
+		writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusServiceUnavailable, Message: err.Error()})
+		return
+	}
+	set := mCtx.modules
+	set.mu.Lock()
+	var modules = []moduleStatus{}
+	for i := 0; i < set.loaded.Count(); i++ {
+		lp := set.loaded.Get(i)
+		modules = append(modules, moduleStatus{ID: lp.Plugin().ID(), Version: lp.Plugin().Version(), State: lp.State().String()})
+	}
+	set.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(modules)
+}
+
+func (h *AdminHandler) restart(w http.ResponseWriter, id plugin.ID) {
+	mCtx, err := loadedModules(h.ctx)
+	if err != nil {
+		writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusServiceUnavailable, Message: err.Error()})
+		return
+	}
+	set := mCtx.modules
+	set.mu.Lock()
+	loaded := set.isLoaded(id)
+	set.mu.Unlock()
+	if !loaded {
+		writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusNotFound, Message: "Module " + string(id) + " is not loaded"})
+		return
+	}
+
+	if err := RestartModule(h.ctx, id); err != nil {
+		writeError(&statusRecorder{ResponseWriter: w}, schema.HTTPError{Code: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rovarghe/mule/plugin"
+	"github.com/rovarghe/mule/test"
+)
+
+func TestAdminHandler(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewAdminHandler(ctx, "s3cret")
+
+	do := func(method, uri string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, uri, nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("GET", "/modules")
+	test.Asserte(t, w.Code == http.StatusOK, "Expected 200, got %d", w.Code)
+	var modules []moduleStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &modules); err != nil {
+		t.Fatal(err)
+	}
+	var ids []plugin.ID
+	for _, m := range modules {
+		ids = append(ids, m.ID)
+		test.Asserte(t, m.State == "DependentsRegistered", "Unexpected state of %s: %s", m.ID, m.State)
+	}
+	test.Asserte(t, reflect.DeepEqual(ids, []plugin.ID{"mule", "pot", "cup"}), "Unexpected modules %v", ids)
+
+	w = do("POST", "/modules/pot/restart")
+	test.Asserte(t, w.Code == http.StatusNoContent, "Expected 204, got %d %s", w.Code, w.Body.String())
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"cup", "pot"}), "Expecting pot and its dependent to restart, got %v", stopped)
+
+	w = do("POST", "/modules/kettle/restart")
+	test.Asserte(t, w.Code == http.StatusNotFound, "Expected 404 for a module that is not loaded, got %d", w.Code)
+
+	w = do("GET", "/modules/pot/restart")
+	test.Asserte(t, w.Code == http.StatusMethodNotAllowed, "Expected 405, got %d", w.Code)
+
+	w = do("GET", "/elsewhere")
+	test.Asserte(t, w.Code == http.StatusNotFound, "Expected 404, got %d", w.Code)
+}
+
+func TestAdminHandlerToken(t *testing.T) {
+	var stopped []plugin.ID
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewAdminHandler(ctx, "s3cret")
+
+	for _, authorization := range []string{"", "Bearer", "Bearer wrong", "s3cret", "Basic s3cret"} {
+		for _, r := range []*http.Request{httptest.NewRequest("GET", "/modules", nil), httptest.NewRequest("POST", "/modules/pot/restart", nil)} {
+			if authorization != "" {
+				r.Header.Set("Authorization", authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			test.Asserte(t, w.Code == http.StatusUnauthorized, "Expected 401 for %s %s with '%s', got %d", r.Method, r.URL, authorization, w.Code)
+		}
+	}
+	test.Asserte(t, len(stopped) == 0, "No module should be restarted, got %v stopped", stopped)
+
+	defer func() {
+		test.Asserte(t, recover() != nil, "Expecting a panic without a token")
+	}()
+	NewAdminHandler(ctx, "")
+}
@@ -12,7 +12,7 @@ import (
 )
 
 var (
-	version1 = plugin.Version{1, 0, 0, ""}
+	version1 = plugin.Version{Major: 1, Minor: 0, Patch: 0}
 
 	CoreModule = schema.Module{
 		Plugin:  plugin.NewPlugin(plugin.ID("mule"), version1, []plugin.Dependency{}),
@@ -24,7 +24,7 @@ var (
 		Plugin: plugin.NewPlugin(plugin.ID("about"), version1, []plugin.Dependency{
 			plugin.Dependency{
 				ID:    CoreModule.Plugin.ID(),
-				Range: plugin.Range{version1, version1, true, true},
+				Range: plugin.Range{Minimum: version1, Maximum: version1, MinInclusive: true, MaxInclusive: true},
 			},
 		}),
 		Starter: schema.StarterFunc(aboutStartupFunc),
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/rovarghe/mule/schema"
+)
+
+type (
+	// Handler is an http.Handler that runs every request through the
+	// loaded modules, first with Process and then with Render
+	Handler struct {
+		ctx context.Context
+	}
+
+	// statusRecorder remembers whether anything has been written to the
+	// client, so that errors are only reported when it is still possible
+	statusRecorder struct {
+		http.ResponseWriter
+		wroteHeader bool
+	}
+)
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// NewHandler returns a Handler serving the modules loaded into ctx by LoadModules
+func NewHandler(ctx context.Context) *Handler {
+	if _, ok := ctx.Value(moduleCtxKey).(moduleLoadingContext); !ok {
+		panic("NewHandler called without a module loading context, call LoadModules first")
+	}
+	return &Handler{ctx: ctx}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := &statusRecorder{ResponseWriter: w}
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Recovered while serving %s %s: %v", r.Method, r.URL, rec)
+			writeError(rw, schema.HTTPError{Code: http.StatusInternalServerError})
+		}
+	}()
+
+	state, processCtx, err := Process(h.ctx, r)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	if _, err = Render(state, processCtx, r, rw); err != nil {
+		writeError(rw, err)
+	}
+}
+
+// writeError converts an error returned by a reducer to an HTTP error response.
+// Errors of type schema.HTTPError keep their status code, anything else is
+// reported as an internal server error.
+func writeError(w *statusRecorder, err error) {
+	var httpErr schema.HTTPError
+
+	switch e := err.(type) {
+	case schema.HTTPError:
+		httpErr = e
+	case *schema.HTTPError:
+		httpErr = *e
+	default:
+		log.Println("Error serving request,", err)
+		httpErr = schema.HTTPError{Code: http.StatusInternalServerError}
+	}
+
+	if w.wroteHeader {
+		// Too late to change the response
+		return
+	}
+
+	if httpErr.Code == 0 {
+		httpErr.Code = http.StatusInternalServerError
+	}
+	if httpErr.Message == "" {
+		httpErr.Message = http.StatusText(httpErr.Code)
+	}
+	http.Error(w, httpErr.Message, httpErr.Code)
+}
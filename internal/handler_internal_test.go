@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rovarghe/mule/internal/builtin"
+	"github.com/rovarghe/mule/plugin"
+	"github.com/rovarghe/mule/schema"
+	"github.com/rovarghe/mule/test"
+)
+
+var forbiddenModule = schema.Module{
+	Plugin: plugin.NewPlugin("forbidden", plugin.Version{Major: 1}, []plugin.Dependency{
+		plugin.Dependency{
+			ID:    builtin.CoreModule.ID(),
+			Range: plugin.Range{Minimum: plugin.Version{Major: 1}, Maximum: plugin.Version{Major: 2}, MinInclusive: true},
+		},
+	}),
+	Starter: schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		base.Get(builtin.CoreModule.ID()).Default().AddRoute("secret",
+			func(state schema.State, ctx schema.ReducerContext, r *http.Request, parent schema.DefaultStateReducer) (schema.State, error) {
+				return nil, schema.HTTPError{Code: http.StatusForbidden}
+			}, nil)
+		return ctx, nil
+	}),
+}
+
+func serve(t *testing.T, modules []schema.Module, uri string, accept string) *httptest.ResponseRecorder {
+	ctx, err := LoadModules(context.Background(), modules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", uri, strings.NewReader(""))
+	if accept != "" {
+		req.Header.Add("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	NewHandler(ctx).ServeHTTP(w, req)
+	return w
+}
+
+func TestHandlerRenders(t *testing.T) {
+	w := serve(t, coreAndAboutModules(), "/about", "application/json")
+
+	test.Asserte(t, w.Code == http.StatusOK, "Expected 200, got %d", w.Code)
+	test.Asserte(t, w.Header().Get("Content-Type") == "application/json", "Unexpected content type %s", w.Header().Get("Content-Type"))
+	test.Asserte(t, w.Body.String() == `{"msg":"About the world"}`, "Unexpected body %s", w.Body.String())
+}
+
+func TestHandlerNotFound(t *testing.T) {
+	w := serve(t, []schema.Module{}, "/nothing", "")
+
+	test.Asserte(t, w.Code == http.StatusNotFound, "Expected 404, got %d", w.Code)
+}
+
+func TestHandlerRecoversPanic(t *testing.T) {
+	// The core renderer panics on content types it does not understand
+	w := serve(t, onlyCoreModule(), "/", "text/plain")
+
+	test.Asserte(t, w.Code == http.StatusInternalServerError, "Expected 500, got %d", w.Code)
+}
+
+func TestHandlerReducerError(t *testing.T) {
+	w := serve(t, append(onlyCoreModule(), forbiddenModule), "/secret", "application/json")
+
+	test.Asserte(t, w.Code == http.StatusForbidden, "Expected 403, got %d", w.Code)
+	test.Asserte(t, strings.TrimSpace(w.Body.String()) == http.StatusText(http.StatusForbidden), "Unexpected body %s", w.Body.String())
+}
@@ -2,9 +2,11 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/rovarghe/mule/loader"
 	"github.com/rovarghe/mule/plugin"
@@ -13,10 +15,17 @@ import (
 
 type (
 	routesCtxKeyType string
-	routersImpl      map[plugin.ID]pathSpecRoutersList
+	routersImpl      map[moduleKey]pathSpecRoutersList
+
+	// moduleKey identifies the routers of a loaded module. Modules are keyed by version
+	// as well as ID, so that several versions of a module can be loaded side by side.
+	moduleKey struct {
+		id      plugin.ID
+		version plugin.Version
+	}
 
 	pluginServeFunc struct {
-		id            plugin.ID
+		id            moduleKey
 		stateReducer  schema.StateReducer
 		renderReducer schema.RenderReducer
 	}
@@ -26,26 +35,59 @@ type (
 	pathSpecRoutersList struct {
 		defaultPathSpec         schema.PathSpec
 		pathSpecServFuncListMap map[schema.PathSpec]pluginServeFuncList
+		// specs are the parsed path specs, in the order added
+		specs []pathSpec
+		// trie matches the specs, it is built when the table is published
+		trie *routeTrie
 	}
 
 	moduleLoadingContext struct {
-		allRouters *routersImpl
+		routes  *routeTable
+		modules *moduleSet
 	}
 
 	pluginLoadingContext struct {
 		moduleLoadingContext
 		loadedPlugin *loader.LoadedPlugin
+		start        *moduleStart
+	}
+
+	// moduleStart is a call to the Starter of a module. If the Starter does not return before
+	// its context is done, e.g. it timed out, the module is rolled back while the Starter may
+	// still be running, so the routes it adds from then on are rejected.
+	moduleStart struct {
+		ctx context.Context
+		// started is set once the Starter returned in time, it is guarded by the routeTable
+		started bool
 	}
 
 	parentLoadingContext struct {
 		pluginLoadingContext
-		parentId plugin.ID
+		parentId moduleKey
 	}
 
 	pathSpecLoadingContext struct {
 		parentLoadingContext
 		pathSpec schema.PathSpec
 	}
+
+	// ModuleError is an error returned by a module's Starter or Stopper
+	ModuleError struct {
+		ID      plugin.ID
+		Version plugin.Version
+		Err     error
+	}
+
+	// ShutdownError is returned by UnloadModules with the errors of every Stopper that failed,
+	// in the order the modules were stopped
+	ShutdownError []ModuleError
+
+	// moduleLogger logs modules as they start and stop, LoadModules always observes the loader with it.
+	// Modules that keep running while others are changed at runtime are not logged.
+	moduleLogger struct {
+		loader.DefaultObserver
+		running map[moduleKey]bool
+	}
 )
 
 /*
@@ -63,8 +105,11 @@ func (r *routersImpl) String() string {
 */
 
 func (psr parentLoadingContext) Default() schema.Router {
-	all := *psr.allRouters
-	return psr.Get(all[psr.parentId].defaultPathSpec)
+	var ps schema.PathSpec
+	psr.routes.update(func(all routersImpl) {
+		ps = all[psr.parentId].defaultPathSpec
+	})
+	return psr.Get(ps)
 
 }
 
@@ -73,52 +118,165 @@ func (psr parentLoadingContext) Get(ps schema.PathSpec) schema.Router {
 }
 
 func (psr pathSpecLoadingContext) AddRoute(ps schema.PathSpec, sf schema.StateReducer, rf schema.RenderReducer) {
-	currentPluginId := psr.loadedPlugin.Plugin().ID()
-	all := *psr.allRouters
-	psrl := all[psr.parentId]
+	currentPluginId := keyOf(psr.loadedPlugin.Plugin())
+	var err error
+	psr.routes.update(func(all routersImpl) {
+		if !psr.start.accepts() {
+			err = errors.New("the module did not start in time")
+			return
+		}
+		err = all.addRoute(psr.parentId, ps, pluginServeFunc{
+			id:            currentPluginId,
+			stateReducer:  sf,
+			renderReducer: rf,
+		}, psr.routes.order)
+	})
+	if err != nil {
+		log.Printf("Route '%s' of module %s %s rejected, %v", ps, currentPluginId.id, currentPluginId.version, err)
+	}
+}
+
+// accepts is true if routes can be added, while the Starter runs or once it returned in time.
+// It must be called with the routeTable locked.
+func (s *moduleStart) accepts() bool {
+	return s.started || s.ctx.Err() == nil
+}
+
+// addRoute adds the route for the path spec under the parent. Routes for the same path spec
+// are kept in the order of their modules, modules missing from order come last. A path spec
+// matching the same URIs as another one under the parent, with other parameter names, is
+// rejected as only one of them could ever be matched.
+func (all routersImpl) addRoute(parentId moduleKey, ps schema.PathSpec, psf pluginServeFunc, order map[moduleKey]int) error {
+	psrl := all[parentId]
 
 	if len(psrl.pathSpecServFuncListMap) == 0 {
 		psrl.defaultPathSpec = ps
 	}
 
-	psf := pluginServeFunc{
-		id:            currentPluginId,
-		stateReducer:  sf,
-		renderReducer: rf,
-	}
 	if psrl.pathSpecServFuncListMap == nil {
 		psrl.pathSpecServFuncListMap = map[schema.PathSpec]pluginServeFuncList{}
 	}
 	if len(psrl.pathSpecServFuncListMap[ps]) == 0 {
+		spec := newPathSpec(string(ps))
+		for _, other := range psrl.specs {
+			if other.shape() == spec.shape() {
+				return fmt.Errorf("it matches the same URIs as '%s'", other.path)
+			}
+		}
 		psrl.pathSpecServFuncListMap[ps] = pluginServeFuncList{psf}
+		psrl.specs = append(psrl.specs, spec)
 	} else {
-		psrl.pathSpecServFuncListMap[ps] = append(psrl.pathSpecServFuncListMap[ps], psf)
+		list := psrl.pathSpecServFuncListMap[ps]
+		i := len(list)
+		if rank, ok := order[psf.id]; ok {
+			for i > 0 {
+				if before, ok := order[list[i-1].id]; !ok || before <= rank {
+					break
+				}
+				i--
+			}
+		}
+		list = append(list, pluginServeFunc{})
+		copy(list[i+1:], list[i:])
+		list[i] = psf
+		psrl.pathSpecServFuncListMap[ps] = list
 	}
 
-	all[psr.parentId] = psrl
+	all[parentId] = psrl
+	return nil
+}
+
+// removeRoutes withdraws every route the plugin added, and the routers under the
+// plugin itself, which only its dependents can add to. The routes of other plugins for
+// the same path spec keep their order, so each still has the same parent to defer to.
+func (all routersImpl) removeRoutes(id moduleKey) {
+	delete(all, id)
+
+	for parentID, psrl := range all {
+		changed := false
+		for ps, list := range psrl.pathSpecServFuncListMap {
+			kept := pluginServeFuncList{}
+			for _, psf := range list {
+				if psf.id != id {
+					kept = append(kept, psf)
+				}
+			}
+			if len(kept) == len(list) {
+				continue
+			}
+			changed = true
+			if len(kept) > 0 {
+				psrl.pathSpecServFuncListMap[ps] = kept
+				continue
+			}
+			delete(psrl.pathSpecServFuncListMap, ps)
+			specs := []pathSpec{}
+			for _, spec := range psrl.specs {
+				if spec.path != ps {
+					specs = append(specs, spec)
+				}
+			}
+			psrl.specs = specs
+		}
+		if changed {
+			all[parentID] = psrl
+		}
+	}
 }
 
 func (pr pluginLoadingContext) Get(id plugin.ID) schema.Routers {
+	routers, ok := pr.Lookup(id)
+	if !ok {
+		panic(fmt.Sprintf("Invalid access, optional module '%s' of '%s' is not present. Use Lookup to check for it.", string(id), pr.loadedPlugin.Plugin().ID()))
+	}
+	return routers
+}
+
+func (pr pluginLoadingContext) Lookup(id plugin.ID) (schema.Routers, bool) {
 
 	// There is an implicit dependency on the RootModuleID/"bootstrap"
 	// All others need to be explicit.
-	if id != schema.RootModuleID {
-		check := false
-		for _, d := range pr.loadedPlugin.Plugin().Dependencies() {
-			if d.ID == id {
-				check = true
-				break
-			}
-		}
+	if id == schema.RootModuleID {
+		return parentLoadingContext{pluginLoadingContext: pr, parentId: keyOf(bootstrapModule)}, true
+	}
 
-		if !check {
-			// This is a dependency specification issue
-			// To Get routers from a Module, there needs to be a dependency to that module
-			panic(fmt.Sprintf("Invalid access, module '%s' is not a dependency of '%s'. Contact module provider.", string(id), pr.loadedPlugin.Plugin().ID()))
+	// The routers are those of the version the dependency was resolved to. Dependencies are
+	// looked at in the order declared, so that the first is found if several have the ID.
+	// Optional dependencies are only linked if present.
+	linked := pr.loadedPlugin.Dependencies()
+	optional := false
+	for _, d := range pr.loadedPlugin.Plugin().Dependencies() {
+		if d.ID != id {
+			continue
 		}
+		if dn, ok := linked[d]; ok {
+			return parentLoadingContext{pluginLoadingContext: pr, parentId: keyOf(dn.Plugin())}, true
+		}
+		optional = optional || d.Optional
+	}
+	if optional {
+		return nil, false
 	}
 
-	return parentLoadingContext{pluginLoadingContext: pr, parentId: id}
+	// This is a dependency specification issue
+	// To Get routers from a Module, there needs to be a dependency to that module
+	panic(fmt.Sprintf("Invalid access, module '%s' is not a dependency of '%s'. Contact module provider.", string(id), pr.loadedPlugin.Plugin().ID()))
+}
+
+func keyOf(p plugin.Plugin) moduleKey {
+	return moduleKey{id: p.ID(), version: p.Version()}
+}
+
+func (e ModuleError) Error() string {
+	return fmt.Sprintf("Module %s %s: %s", e.ID, e.Version, e.Err)
+}
+
+func (e ShutdownError) Error() string {
+	str := fmt.Sprintf("%d module(s) failed to stop", len(e))
+	for _, me := range e {
+		str = fmt.Sprintf("%s\n %s", str, me.Error())
+	}
+	return str
 }
 
 type notFoundType struct{}
@@ -140,7 +298,7 @@ func defaultRenderer(state schema.State, ctx schema.ReducerContext, r *http.Requ
 
 var (
 	bootstrapModule = schema.Module{
-		Plugin:  plugin.NewPlugin("bootstrap", plugin.Version{1, 0, 0, ""}, []plugin.Dependency{}),
+		Plugin:  plugin.NewPlugin("bootstrap", plugin.Version{Major: 1, Minor: 0, Patch: 0}, []plugin.Dependency{}),
 		Starter: nil,
 		Stopper: nil,
 	}
@@ -153,42 +311,96 @@ var (
 
 func newModuleLoadingContext() moduleLoadingContext {
 	return moduleLoadingContext{
-		allRouters: &routersImpl{
-			bootstrapModule.ID(): pathSpecRoutersList{
+		modules: &moduleSet{},
+		routes: newRouteTable(routersImpl{
+			keyOf(bootstrapModule): pathSpecRoutersList{
 				defaultPathSpec: emptyPathSpec,
 				pathSpecServFuncListMap: map[schema.PathSpec]pluginServeFuncList{
 					emptyPathSpec: pluginServeFuncList{
 						pluginServeFunc{
-							id:            bootstrapModule.ID(),
+							id:            keyOf(bootstrapModule),
 							stateReducer:  notFoundServeFunc,
 							renderReducer: defaultRenderer,
 						},
 					},
 				},
 			},
-		},
+		}),
 	}
 }
 
-func LoadModules(ctx context.Context, modules []schema.Module) (context.Context, error) {
+// LoadModules starts the modules in order of their dependencies. Options are passed on to
+// loader.Load, e.g. to load several versions of a module side by side.
+func LoadModules(ctx context.Context, modules []schema.Module, opts ...loader.Option) (context.Context, error) {
 
-	var plugins = make([]plugin.Plugin, len(modules))
+	mCtx := newModuleLoadingContext()
+	ctx = context.WithValue(ctx, moduleCtxKey, mCtx)
 
-	for i := 0; i < len(modules); i++ {
-		plugins[i] = modules[i]
-	}
-	ctx = context.WithValue(ctx, moduleCtxKey, newModuleLoadingContext())
+	set := mCtx.modules
+	set.modules = append([]schema.Module{}, modules...)
+	set.opts = opts
+
+	// Routes are ordered by the plan, so parallel starts add them as a sequential one would
+	plan, _ := loader.Plan(pluginsOf(modules), opts...)
+	mCtx.routes.setOrder(plan)
 
-	ctx, loadedPlugins, err := loader.Load(ctx, plugins, startModule)
+	ctx, loadedPlugins, err := loader.Load(ctx, pluginsOf(modules), startModule, set.loadOptions(nil, unloadModule)...)
 
 	if err != nil {
 		log.Println("Load incomplete,", loadedPlugins.Count(), "modules loaded")
 	}
+	set.loaded = loadedPlugins
+	mCtx.routes.publish()
 
 	return ctx, err
 
 }
 
+// PlanModules reports what LoadModules would do with the modules, without starting any.
+// See loader.Plan.
+func PlanModules(modules []schema.Module, opts ...loader.Option) (*loader.LoadPlan, error) {
+	return loader.Plan(pluginsOf(modules), opts...)
+}
+
+func pluginsOf(modules []schema.Module) []plugin.Plugin {
+	var plugins = make([]plugin.Plugin, len(modules))
+	for i := 0; i < len(modules); i++ {
+		plugins[i] = modules[i]
+	}
+	return plugins
+}
+
+// UnloadModules calls the Stopper of every module started by LoadModules, in the reverse
+// order they were started, withdrawing the routes of each before it stops. All modules are
+// stopped even if some fail or time out, the errors are returned together as a ShutdownError.
+func UnloadModules(ctx context.Context) (context.Context, error) {
+	mCtx, ok := ctx.Value(moduleCtxKey).(moduleLoadingContext)
+	if !ok || mCtx.modules.loaded == nil {
+		return ctx, errors.New("UnloadModules called without loaded modules, call LoadModules first")
+	}
+	set := mCtx.modules
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	// Every module gets a chance to stop, even if some fail or time out. Its routes are no
+	// longer served once it is stopping.
+	var errs ShutdownError
+	ctx, stopErrs := set.loaded.UnloadWhere(ctx, func(*loader.LoadedPlugin) bool { return true },
+		func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+			withdrawModule(mCtx, lp)
+			mCtx.routes.publish()
+			return stopModule(ctx, lp)
+		})
+	for _, e := range stopErrs {
+		errs = append(errs, ModuleError{ID: e.Plugin.ID(), Version: e.Plugin.Version(), Err: e.Err})
+	}
+
+	if len(errs) > 0 {
+		return ctx, errs
+	}
+	return ctx, nil
+}
+
 func startModule(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
 
 	mCtx := ctx.Value(moduleCtxKey).(moduleLoadingContext)
@@ -202,16 +414,87 @@ func startModule(ctx context.Context, lp *loader.LoadedPlugin) (context.Context,
 	}
 
 	if module.Starter == nil {
-		log.Printf("Starting module: (%s, %s)", plugin.ID(), plugin.Version())
+		// Recorded with the routes locked, so it is not recorded after being withdrawn
+		mCtx.routes.update(func(routersImpl) {
+			if ctx.Err() == nil {
+				mCtx.modules.started(keyOf(module), ctx)
+			}
+		})
 		return ctx, nil
 	}
 
-	log.Printf("Starting module: %s %s", plugin.ID(), plugin.Version())
-
+	start := &moduleStart{ctx: ctx}
 	mLoadingCtx := pluginLoadingContext{
 		moduleLoadingContext: mCtx,
 		loadedPlugin:         lp,
+		start:                start,
+	}
+
+	ctx, err := module.Starter.Start(ctx, mLoadingCtx)
+	if err == nil {
+		// A Starter completing after its start timed out is rolled back, its context is not
+		// recorded
+		mCtx.routes.update(func(routersImpl) {
+			if start.started = start.ctx.Err() == nil; start.started {
+				mCtx.modules.started(keyOf(module), ctx)
+			}
+		})
 	}
+	return ctx, err
+}
+
+func stopModule(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+
+	plugin := lp.Plugin()
+	module := plugin.(schema.Module)
+
+	// Only modules whose Starter completed are stopped
+	if lp.State() == loader.DependenciesRegistered || module.Stopper == nil {
+		return ctx, nil
+	}
+
+	stopCtx, err := module.Stopper.Stop(ctx)
+	if stopCtx == nil {
+		stopCtx = ctx
+	}
+	return stopCtx, err
+}
+
+func (l moduleLogger) Starting(lp *loader.LoadedPlugin) {
+	if lp.Plugin().ID() != bootstrapModule.ID() && !l.running[keyOf(lp.Plugin())] {
+		log.Printf("Starting module: %s %s", lp.Plugin().ID(), lp.Plugin().Version())
+	}
+}
+
+func (l moduleLogger) Started(lp *loader.LoadedPlugin, elapsed time.Duration) {
+	if lp.Plugin().ID() != bootstrapModule.ID() && !l.running[keyOf(lp.Plugin())] {
+		log.Printf("Started module: %s %s in %s", lp.Plugin().ID(), lp.Plugin().Version(), elapsed)
+	}
+}
+
+func (moduleLogger) Failed(lp *loader.LoadedPlugin, err error) {
+	log.Printf("Module failed to start: %s %s: %v", lp.Plugin().ID(), lp.Plugin().Version(), err)
+}
+
+func (l moduleLogger) Stopping(lp *loader.LoadedPlugin) {
+	// Modules that did not start are not stopped, see stopModule
+	if lp.State() != loader.DependenciesRegistered && lp.Plugin().ID() != bootstrapModule.ID() && !l.running[keyOf(lp.Plugin())] {
+		log.Printf("Stopping module: %s %s", lp.Plugin().ID(), lp.Plugin().Version())
+	}
+}
+
+// unloadModule undoes startModule: it withdraws every route the module added, then stops it,
+// so that nothing is served by a stopped module once the routes are published, even if its
+// Stopper fails or does not return in time
+func unloadModule(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+	withdrawModule(ctx.Value(moduleCtxKey).(moduleLoadingContext), lp)
+	return stopModule(ctx, lp)
+}
 
-	return module.Starter.Start(ctx, mLoadingCtx)
+// withdrawModule removes the routes of a module from the draft, and forgets its context
+func withdrawModule(mCtx moduleLoadingContext, lp *loader.LoadedPlugin) {
+	mCtx.routes.update(func(all routersImpl) {
+		mCtx.modules.stopped(keyOf(lp.Plugin()))
+		all.removeRoutes(keyOf(lp.Plugin()))
+	})
 }
@@ -2,15 +2,22 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rovarghe/mule/internal/builtin"
+	"github.com/rovarghe/mule/loader"
+	"github.com/rovarghe/mule/plugin"
 	"github.com/rovarghe/mule/schema"
+	"github.com/rovarghe/mule/test"
 )
 
 func onlyCoreModule() []schema.Module {
@@ -27,9 +34,9 @@ func TestBuiltInModules(t *testing.T) {
 		t.Error(err)
 	}
 	moduleLoadingCtx := ctx.Value(moduleCtxKey).(moduleLoadingContext)
-	allRouters := *(moduleLoadingCtx.allRouters)
+	allRouters := moduleLoadingCtx.routes.snapshot()
 
-	if _, ok := allRouters[schema.RootModuleID]; !ok {
+	if _, ok := allRouters[keyOf(bootstrapModule)]; !ok {
 		t.Fatal("Root module not in allRouters")
 	}
 
@@ -66,3 +73,458 @@ func TestProcessAndRender(t *testing.T) {
 	fmt.Println(mockWriter.HeaderMap.Write(os.Stdout))
 	fmt.Println(mockWriter.Body.String())
 }
+
+func recordingModule(id plugin.ID, stopped *[]plugin.ID, stopErr error, deps ...plugin.ID) schema.Module {
+	var dependencies = []plugin.Dependency{}
+	for _, d := range deps {
+		dependencies = append(dependencies, plugin.Dependency{
+			ID:    d,
+			Range: plugin.Range{Minimum: plugin.Version{Major: 1}, Maximum: plugin.Version{Major: 2}, MinInclusive: true},
+		})
+	}
+	return schema.Module{
+		Plugin: plugin.NewPlugin(id, plugin.Version{Major: 1}, dependencies),
+		Starter: schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+			return ctx, nil
+		}),
+		Stopper: schema.StopperFunc(func(ctx context.Context) (context.Context, error) {
+			*stopped = append(*stopped, id)
+			return ctx, stopErr
+		}),
+	}
+}
+
+func TestUnloadModules(t *testing.T) {
+	var stopped []plugin.ID
+	modules := []schema.Module{
+		recordingModule("db", &stopped, nil),
+		recordingModule("cache", &stopped, errors.New("flush failed"), "db"),
+		recordingModule("api", &stopped, nil, "cache"),
+	}
+
+	ctx, err := LoadModules(context.Background(), modules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = UnloadModules(ctx)
+
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"api", "cache", "db"}), "Unexpected stop order %v", stopped)
+
+	shutdownErr, ok := err.(ShutdownError)
+	if !ok {
+		t.Fatalf("Expecting ShutdownError, got %v", err)
+	}
+	test.Asserte(t, len(shutdownErr) == 1 && shutdownErr[0].ID == "cache", "Unexpected errors %v", shutdownErr)
+}
+
+func TestUnloadModulesWithoutLoad(t *testing.T) {
+	_, err := UnloadModules(context.Background())
+	test.Asserte(t, err != nil, "Expecting error when nothing was loaded")
+}
+
+func TestLoadModulesRollback(t *testing.T) {
+	var stopped []plugin.ID
+	addRoute := func(spec schema.PathSpec, err error) schema.Starter {
+		return schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+			base.Get(builtin.CoreModule.ID()).Default().AddRoute(spec, notFoundServeFunc, defaultRenderer)
+			return ctx, err
+		})
+	}
+
+	started := recordingModule("started", &stopped, nil, builtin.CoreModule.ID())
+	started.Starter = addRoute("started", nil)
+	failing := recordingModule("failing", &stopped, nil, builtin.CoreModule.ID(), "started")
+	failing.Starter = addRoute("failing", errors.New("cannot start"))
+
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), started, failing))
+
+	if _, ok := err.(loader.RollbackLoadError); !ok {
+		t.Fatal("Expecting RollbackLoadError, got", err)
+	}
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"started"}), "Only the started module should be stopped, got %v", stopped)
+
+	allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+	test.Asserte(t, len(allRouters) == 1, "Expecting only bootstrap routers, got %v", allRouters)
+	rootRoutes := allRouters[keyOf(bootstrapModule)].pathSpecServFuncListMap
+	test.Asserte(t, len(rootRoutes) == 1 && len(rootRoutes[emptyPathSpec]) == 1, "Expecting only the bootstrap route, got %v", rootRoutes)
+}
+
+func TestLoadModulesSideBySide(t *testing.T) {
+	var stopped []plugin.ID
+	api1 := recordingModule("api", &stopped, nil, builtin.CoreModule.ID())
+	api2 := recordingModule("api", &stopped, nil, builtin.CoreModule.ID())
+	api2.Plugin = plugin.NewPlugin("api", plugin.Version{Major: 1, Minor: 5}, api1.Dependencies())
+	client := recordingModule("client", &stopped, nil)
+	client.Plugin = plugin.NewPlugin("client", plugin.Version{Major: 1}, []plugin.Dependency{
+		plugin.Dependency{
+			ID:    "api",
+			Range: plugin.Range{Minimum: plugin.Version{Major: 1}, Maximum: plugin.Version{Major: 1, Minor: 5}, MinInclusive: true},
+		},
+	})
+	client.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		base.Get("api").Default().AddRoute("client", notFoundServeFunc, defaultRenderer)
+		return ctx, nil
+	})
+
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), api1, api2, client), loader.WithVersionPolicy(loader.SideBySide))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+	v1Routes := allRouters[keyOf(api1)].pathSpecServFuncListMap
+	_, v2HasRouters := allRouters[keyOf(api2)]
+	test.Asserte(t, len(v1Routes["client"]) == 1, "Expecting client route under api 1.0.0, got %v", v1Routes)
+	test.Asserte(t, !v2HasRouters, "Expecting no routes under api 1.5.0")
+}
+
+func TestLookupDeclaredOrder(t *testing.T) {
+	var stopped []plugin.ID
+	api1 := recordingModule("api", &stopped, nil, builtin.CoreModule.ID())
+	api2 := recordingModule("api", &stopped, nil, builtin.CoreModule.ID())
+	api2.Plugin = plugin.NewPlugin("api", plugin.Version{Major: 1, Minor: 5}, api1.Dependencies())
+	exactly := func(v plugin.Version) plugin.Range {
+		return plugin.Range{Minimum: v, Maximum: v, MinInclusive: true, MaxInclusive: true}
+	}
+	client := recordingModule("client", &stopped, nil)
+	client.Plugin = plugin.NewPlugin("client", plugin.Version{Major: 1}, []plugin.Dependency{
+		plugin.Dependency{ID: "api", Range: exactly(api2.Version())},
+		plugin.Dependency{ID: "api", Range: exactly(api1.Version())},
+	})
+	client.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		base.Get("api").Default().AddRoute("client", notFoundServeFunc, defaultRenderer)
+		return ctx, nil
+	})
+
+	// The first dependency declared is used every time
+	for i := 0; i < 10; i++ {
+		ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), api1, api2, client), loader.WithVersionPolicy(loader.SideBySide))
+		if err != nil {
+			t.Fatal(err)
+		}
+		allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+		v2Routes := allRouters[keyOf(api2)].pathSpecServFuncListMap
+		test.Asserte(t, len(v2Routes["client"]) == 1, "Expecting client route under api 1.5.0, got %v", allRouters)
+	}
+}
+
+func TestLoadModulesOptionalDependency(t *testing.T) {
+	var stopped []plugin.ID
+	var present []bool
+	metrics := recordingModule("mule-metrics", &stopped, nil, builtin.CoreModule.ID())
+	web := recordingModule("web", &stopped, nil, builtin.CoreModule.ID())
+	web.Plugin = plugin.NewPlugin("web", plugin.Version{Major: 1}, append(web.Dependencies(), plugin.Dependency{
+		ID:       "mule-metrics",
+		Range:    plugin.Range{Minimum: plugin.Version{Major: 1}, NoMaximum: true, MinInclusive: true},
+		Optional: true,
+	}))
+	web.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		routers, ok := base.Lookup("mule-metrics")
+		present = append(present, ok)
+		if ok {
+			routers.Default().AddRoute("web", notFoundServeFunc, defaultRenderer)
+		}
+		return ctx, nil
+	})
+
+	_, err := LoadModules(context.Background(), append(onlyCoreModule(), web))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), web, metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(present, []bool{false, true}), "Unexpected presence of mule-metrics %v", present)
+
+	allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+	metricsRoutes := allRouters[keyOf(metrics)].pathSpecServFuncListMap
+	test.Asserte(t, len(metricsRoutes["web"]) == 1, "Expecting web route under mule-metrics, got %v", metricsRoutes)
+}
+
+func TestLoadModulesParallel(t *testing.T) {
+	var stopped []plugin.ID
+	var modules = onlyCoreModule()
+	for _, id := range []plugin.ID{"users", "orders", "stock", "billing"} {
+		m := recordingModule(id, &stopped, nil, builtin.CoreModule.ID())
+		spec := schema.PathSpec(id)
+		m.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+			base.Get(builtin.CoreModule.ID()).Default().AddRoute(spec, notFoundServeFunc, defaultRenderer)
+			return ctx, nil
+		})
+		modules = append(modules, m)
+	}
+
+	ctx, err := LoadModules(context.Background(), modules, loader.WithParallelism(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+	coreRoutes := allRouters[keyOf(builtin.CoreModule)].pathSpecServFuncListMap
+	test.Asserte(t, len(coreRoutes) == 4, "Expecting a route for each module under core, got %v", coreRoutes)
+}
+
+func TestLoadModulesParallelRouteOrder(t *testing.T) {
+	var stopped []plugin.ID
+	secondAdded := make(chan struct{})
+	first := recordingModule("first", &stopped, nil, builtin.CoreModule.ID())
+	first.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		// Completes after second, but comes before it in the load order
+		<-secondAdded
+		base.Get(builtin.CoreModule.ID()).Default().AddRoute("shared", notFoundServeFunc, defaultRenderer)
+		return ctx, nil
+	})
+	second := recordingModule("second", &stopped, nil, builtin.CoreModule.ID())
+	second.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		base.Get(builtin.CoreModule.ID()).Default().AddRoute("shared", notFoundServeFunc, defaultRenderer)
+		close(secondAdded)
+		return ctx, nil
+	})
+	modules := append(onlyCoreModule(), first, second)
+
+	plan, err := PlanModules(modules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []moduleKey
+	for _, p := range plan.Order {
+		if p.ID() == "first" || p.ID() == "second" {
+			expected = append(expected, keyOf(p))
+		}
+	}
+
+	ctx, err := LoadModules(context.Background(), modules, loader.WithParallelism(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+	var ids []moduleKey
+	for _, psf := range allRouters[keyOf(builtin.CoreModule)].pathSpecServFuncListMap["shared"] {
+		ids = append(ids, psf.id)
+	}
+	test.Asserte(t, reflect.DeepEqual(ids, expected), "Expecting the routes in load order %v, got %v", expected, ids)
+}
+
+func TestLoadModulesStartTimeout(t *testing.T) {
+	var stopped []plugin.ID
+	slow := recordingModule("slow", &stopped, nil, builtin.CoreModule.ID())
+	slow.Plugin = plugin.Manifest{ID: "slow", Version: plugin.Version{Major: 1}, Dependencies: slow.Dependencies(),
+		StartTimeout: plugin.Duration(20 * time.Millisecond)}.Plugin()
+	slow.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		<-ctx.Done()
+		return ctx, ctx.Err()
+	})
+
+	_, err := LoadModules(context.Background(), append(onlyCoreModule(), slow), loader.WithStartTimeout(time.Hour))
+
+	var timeoutErr loader.TimeoutError
+	test.Asserte(t, errors.As(err, &timeoutErr), "Expecting TimeoutError, got %v", err)
+	test.Asserte(t, timeoutErr.Plugin.ID() == "slow" && timeoutErr.Timeout == 20*time.Millisecond,
+		"Expecting the timeout of the slow module, got %v", timeoutErr)
+	test.Asserte(t, len(stopped) == 0, "The slow module never started, it should not be stopped, got %v", stopped)
+}
+
+func TestLoadModulesStartTimeoutRejectsLateRoutes(t *testing.T) {
+	var stopped []plugin.ID
+	release, added := make(chan struct{}), make(chan struct{})
+	slow := recordingModule("slow", &stopped, nil, builtin.CoreModule.ID())
+	slow.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		// Ignores its context, adding a route after it was rolled back
+		<-release
+		base.Get(builtin.CoreModule.ID()).Default().AddRoute("slow", notFoundServeFunc, defaultRenderer)
+		close(added)
+		return context.WithValue(ctx, lateKey{}, true), nil
+	})
+
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), slow), loader.WithStartTimeout(20*time.Millisecond))
+	var timeoutErr loader.TimeoutError
+	test.Asserte(t, errors.As(err, &timeoutErr), "Expecting TimeoutError, got %v", err)
+
+	close(release)
+	<-added
+	mCtx := ctx.Value(moduleCtxKey).(moduleLoadingContext)
+	mCtx.routes.publish()
+	coreRoutes := mCtx.routes.snapshot()[keyOf(builtin.CoreModule)].pathSpecServFuncListMap
+	test.Asserte(t, len(coreRoutes["slow"]) == 0, "Expecting the late route to be rejected, got %v", coreRoutes)
+	// Give the late Starter time to return
+	time.Sleep(20 * time.Millisecond)
+	late := mCtx.modules.contextOf(keyOf(slow), context.Background()).Value(lateKey{})
+	test.Asserte(t, late == nil, "Expecting the context of the rolled back module not to be recorded")
+}
+
+type lateKey struct{}
+
+func TestUnloadModulesWithdrawsRoutes(t *testing.T) {
+	var stopped []plugin.ID
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mCtx := ctx.Value(moduleCtxKey).(moduleLoadingContext)
+	served := mCtx.routes.snapshot()
+
+	if _, err := UnloadModules(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	allRouters := mCtx.routes.snapshot()
+	test.Asserte(t, len(allRouters) == 1, "Expecting only bootstrap routers, got %v", allRouters)
+	rootRoutes := allRouters[keyOf(bootstrapModule)].pathSpecServFuncListMap
+	test.Asserte(t, len(rootRoutes) == 1 && len(rootRoutes[emptyPathSpec]) == 1, "Expecting only the bootstrap route, got %v", rootRoutes)
+	test.Asserte(t, len(served[keyOf(builtin.CoreModule)].pathSpecServFuncListMap["tea"]) == 1, "The table being served should not change")
+
+	state, _, _ := Process(ctx, httptest.NewRequest("GET", "/tea", nil))
+	_, notFound := state.(notFoundType)
+	test.Asserte(t, notFound, "Expecting not found once unloaded, got %v", state)
+}
+
+func TestUnloadModulesStopTimeout(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	cup.Stopper = schema.StopperFunc(func(ctx context.Context) (context.Context, error) {
+		<-ctx.Done()
+		return ctx, nil
+	})
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup), loader.WithStopTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The modules after the one that timed out are stopped too
+	_, err = UnloadModules(ctx)
+	shutdownErr, ok := err.(ShutdownError)
+	var timeoutErr loader.TimeoutError
+	test.Asserte(t, ok && len(shutdownErr) == 1 && shutdownErr[0].ID == "cup" && errors.As(shutdownErr[0].Err, &timeoutErr),
+		"Expecting cup to time out, got %v", err)
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"pot"}), "Expecting pot to stop, got %v", stopped)
+
+	coreRoutes := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()[keyOf(builtin.CoreModule)].pathSpecServFuncListMap
+	test.Asserte(t, len(coreRoutes["cup"]) == 0, "Expecting the routes of cup to be withdrawn, got %v", coreRoutes)
+}
+
+func TestWithdrawnRoutesKeepParentChain(t *testing.T) {
+	var stopped, calls []plugin.ID
+	overriding := func(id plugin.ID) schema.Module {
+		m := recordingModule(id, &stopped, nil, builtin.CoreModule.ID())
+		m.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+			base.Get(builtin.CoreModule.ID()).Default().AddRoute("x",
+				func(state schema.State, ctx schema.ReducerContext, r *http.Request, parent schema.DefaultStateReducer) (schema.State, error) {
+					calls = append(calls, id)
+					return parent(state, r)
+				}, nil)
+			return ctx, nil
+		})
+		return m
+	}
+	process := func(ctx context.Context) []plugin.ID {
+		calls = nil
+		if _, _, err := Process(ctx, httptest.NewRequest("GET", "/x", nil)); err != nil {
+			t.Fatal(err)
+		}
+		return calls
+	}
+
+	a, b := overriding("a"), overriding("b")
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), a, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(process(ctx), []plugin.ID{"b", "a"}), "Expecting b to defer to a, got %v", calls)
+
+	if err := RemoveModule(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(process(ctx), []plugin.ID{"b"}), "Expecting only b once a is removed, got %v", calls)
+
+	if err := InstallModule(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(process(ctx), []plugin.ID{"a", "b"}), "Expecting a to defer to b once installed again, got %v", calls)
+
+	if err := RemoveModule(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(process(ctx), []plugin.ID{"a"}), "Expecting only a once b is removed, got %v", calls)
+}
+
+// manifestModule is a recordingModule declared by a manifest
+func manifestModule(t *testing.T, manifest string, stopped *[]plugin.ID) schema.Module {
+	var m plugin.Manifest
+	if err := json.Unmarshal([]byte(manifest), &m); err != nil {
+		t.Fatal(err)
+	}
+	module := recordingModule(m.ID, stopped, nil)
+	module.Plugin = m.Plugin()
+	return module
+}
+
+func TestLoadModulesConflicts(t *testing.T) {
+	var stopped []plugin.ID
+	about := manifestModule(t, `{"id": "about", "version": "1.0.0", "dependencies": ["mule ^1"], "conflicts": ["legacy-about *"]}`, &stopped)
+	legacy := manifestModule(t, `{"id": "legacy-about", "version": "1.0.0", "dependencies": ["mule ^1"]}`, &stopped)
+
+	_, err := LoadModules(context.Background(), append(onlyCoreModule(), about, legacy))
+	if _, ok := err.(loader.ConflictLoadError); !ok {
+		t.Fatal("Expecting ConflictLoadError, got", err)
+	}
+	test.Asserte(t, len(stopped) == 0, "No module should be started, got %v stopped", stopped)
+}
+
+func TestLoadModulesReplaces(t *testing.T) {
+	var stopped []plugin.ID
+	legacy := manifestModule(t, `{"id": "legacy-about", "version": "1.0.0", "dependencies": ["mule ^1"]}`, &stopped)
+	about := manifestModule(t, `{"id": "about", "version": "1.0.0", "dependencies": ["mule ^1"], "replaces": ["legacy-about *"]}`, &stopped)
+	web := manifestModule(t, `{"id": "web", "version": "1.0.0", "dependencies": ["legacy-about ^1"]}`, &stopped)
+	web.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		base.Get("legacy-about").Default().AddRoute("web", notFoundServeFunc, defaultRenderer)
+		return ctx, nil
+	})
+
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), legacy, about, web))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dependency on the replaced module is linked to its replacement
+	allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+	aboutRoutes := allRouters[keyOf(about)].pathSpecServFuncListMap
+	test.Asserte(t, len(aboutRoutes["web"]) == 1, "Expecting web route under about, got %v", allRouters)
+
+	UnloadModules(ctx)
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"web", "about"}), "Expecting the replaced module not to run, got %v stopped", stopped)
+}
+
+func TestLoadModulesCapabilities(t *testing.T) {
+	var stopped []plugin.ID
+	memory := manifestModule(t, `{"id": "memory-sessions", "version": "1.0.0", "dependencies": ["mule ^1"], "provides": ["session-store 1.0.0"]}`, &stopped)
+	redis := manifestModule(t, `{"id": "redis-sessions", "version": "1.0.0", "dependencies": ["mule ^1"], "provides": ["session-store 1.0.0"]}`, &stopped)
+	web := manifestModule(t, `{"id": "web", "version": "1.0.0", "dependencies": ["session-store ^1 capability"]}`, &stopped)
+	web.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		base.Get("session-store").Default().AddRoute("web", notFoundServeFunc, defaultRenderer)
+		return ctx, nil
+	})
+
+	var table = []struct {
+		opts     []loader.Option
+		provider schema.Module
+	}{
+		// Ties are broken by the lowest plugin ID
+		{nil, memory},
+		{[]loader.Option{loader.WithProvider("session-store", "redis-sessions")}, redis},
+	}
+
+	for _, r := range table {
+		ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), memory, redis, web), r.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allRouters := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+		providerRoutes := allRouters[keyOf(r.provider)].pathSpecServFuncListMap
+		test.Asserte(t, len(providerRoutes["web"]) == 1, "Expecting web route under %s, got %v", r.provider.ID(), allRouters)
+	}
+}
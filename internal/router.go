@@ -4,24 +4,33 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 
-	"github.com/rovarghe/mule/plugin"
 	"github.com/rovarghe/mule/schema"
 )
 
 type (
 	pathVariables string
-	sanitizedPath []string
 
 	pathParameter struct {
 		name  string
 		regex string
+		// matcher is the compiled regex, nil if the parameter matches any URI part
+		matcher *regexp.Regexp
+		// catchAll is true for a parameter written {name...}, matching the rest of the URI
+		catchAll bool
+	}
+
+	// pathSegment is a URI part of a path spec, either literal or a parameter
+	pathSegment struct {
+		literal string
+		param   *pathParameter
 	}
 
 	pathSpec struct {
-		sanitizedPath []string
-		pathArgs      map[int]pathParameter
+		path     schema.PathSpec
+		segments []pathSegment
 	}
 
 	// NextHandler is called to invoke the next function in the chain
@@ -68,51 +77,127 @@ func DefaultNextHandler(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	http.NotFound(w, r)
 }
 
+// extractPathParameter parses a parameter written {name}, {name:regex} or {name...},
+// compiling its regex. Panics if the regex is invalid, as that is a module programming error.
 func extractPathParameter(str string) *pathParameter {
-	if strings.HasPrefix(str, "{") && strings.HasSuffix(str, "}") {
-		var name, regex string
-		if i := strings.Index(str, ":"); i < 0 {
-			name = str[1 : len(str)-1]
-			regex = "[^/]+"
-		} else {
-			name = str[1:i]
-			regex = str[i+1:]
+	if !strings.HasPrefix(str, "{") || !strings.HasSuffix(str, "}") {
+		return nil
+	}
+
+	inner := str[1 : len(str)-1]
+	if strings.HasSuffix(inner, "...") {
+		return &pathParameter{
+			name:     strings.TrimSuffix(inner, "..."),
+			regex:    ".+",
+			catchAll: true,
 		}
+	}
+
+	i := strings.Index(inner, ":")
+	if i < 0 {
 		return &pathParameter{
-			name:  name,
-			regex: regex,
+			name:  inner,
+			regex: "[^/]+",
 		}
 	}
-	return nil
 
+	regex := inner[i+1:]
+	matcher, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		panic(fmt.Sprintf("Invalid path parameter '%s': %s", str, err))
+	}
+	return &pathParameter{
+		name:    inner[:i],
+		regex:   regex,
+		matcher: matcher,
+	}
+}
+
+// predicate identifies the URI parts the parameter matches, whatever its name: its regex, or
+// "" if it matches any URI part
+func (param pathParameter) predicate() string {
+	if param.matcher == nil {
+		return ""
+	}
+	return param.regex
 }
 
+// matches is true if the URI part is a value of the parameter
+func (param pathParameter) matches(part string) bool {
+	if param.matcher == nil {
+		return part != ""
+	}
+	return param.matcher.MatchString(part)
+}
+
+// newPathSpec parses a path template such as "users/{id:[0-9]+}" and compiles the regular
+// expressions of its parameters. A catch-all parameter such as "files/{path...}" can only
+// be the last part.
+// Panics if the path spec is invalid, as that is a module programming error.
 func newPathSpec(path string) pathSpec {
 	sp := strings.Split(path, "/")
-	pa := make(map[int]pathParameter)
+	segments := make([]pathSegment, len(sp))
 
 	for i := 0; i < len(sp); i++ {
-		if param := extractPathParameter(sp[i]); param != nil {
-			sp[i] = fmt.Sprintf("{%d}", len(pa))
-			pa[len(pa)] = *param
+		param := extractPathParameter(sp[i])
+		if param == nil {
+			segments[i] = pathSegment{literal: sp[i]}
+			continue
+		}
+		if param.catchAll && i != len(sp)-1 {
+			panic(fmt.Sprintf("Invalid path spec '%s': %s must be the last part", path, sp[i]))
 		}
+		segments[i] = pathSegment{param: param}
 	}
+
 	return pathSpec{
-		sanitizedPath: sp,
-		pathArgs:      pa,
+		path:     schema.PathSpec(path),
+		segments: segments,
+	}
+
+}
+
+// shape is the path spec without the names of its parameters. Path specs with the same shape
+// match the same URIs.
+func (ps pathSpec) shape() string {
+	parts := make([]string, len(ps.segments))
+	for i, segment := range ps.segments {
+		switch {
+		case segment.param == nil:
+			parts[i] = segment.literal
+		case segment.param.catchAll:
+			parts[i] = "{...}"
+		default:
+			parts[i] = "{:" + segment.param.predicate() + "}"
+		}
 	}
+	return strings.Join(parts, "/")
+}
 
+// match finds the routes for the URI parts beginning at index i, see routeTrie.
+// Returns the routes, the number of URI parts consumed and the path parameters captured.
+func (psrl pathSpecRoutersList) match(uriParts []string, i int) (pluginServeFuncList, int, map[string]string) {
+	if psrl.trie == nil {
+		return nil, 0, nil
+	}
+	spec, consumed, params := psrl.trie.match(uriParts, i)
+	if spec == nil {
+		return nil, 0, nil
+	}
+	return psrl.pathSpecServFuncListMap[spec.path], consumed, params
 }
 
 type processContext struct {
-	moduleCtx                 moduleLoadingContext
-	currentModuleID           plugin.ID
+	// routers is the published route table the request is served from, see routeTable
+	routers                   routersImpl
+	currentModuleID           moduleKey
 	currentRoutersForModule   pathSpecRoutersList
 	currentRoutersForPathSpec pluginServeFuncList
 	funcIndex                 int
 	uriParts                  []string
 	uriIndex                  int
 	depth                     int
+	pathParams                map[string]string
 }
 
 func (pctx processContext) URI() schema.PathSpec {
@@ -125,7 +210,24 @@ func (pctx processContext) Final() bool {
 }
 
 func (pctx processContext) PathParameters() map[string]string {
-	return map[string]string{}
+	params := make(map[string]string, len(pctx.pathParams))
+	for k, v := range pctx.pathParams {
+		params[k] = v
+	}
+	return params
+}
+
+// withPathParams returns a copy of the path parameters with new ones added.
+// Parameters are shared between copies of processContext, so they are never changed in place.
+func (pctx processContext) withPathParams(params map[string]string) map[string]string {
+	if len(params) == 0 {
+		return pctx.pathParams
+	}
+	merged := pctx.PathParameters()
+	for k, v := range params {
+		merged[k] = v
+	}
+	return merged
 }
 
 type processContextKeyType string
@@ -136,8 +238,13 @@ var processContextKey = processContextKeyType("processContext")
 
 //var renderContextKey = renderContextKeyType("renderContext")
 
+// Process runs the request through the state reducers of the routes it matches. The routes
+// are those published when the request arrived, Render then uses the same ones.
 func Process(ctx context.Context, req *http.Request) (schema.State, context.Context, error) {
 	uri := req.RequestURI
+	if req.URL != nil {
+		uri = req.URL.Path
+	}
 
 	moduleCtx := ctx.Value(moduleCtxKey).(moduleLoadingContext)
 
@@ -145,13 +252,14 @@ func Process(ctx context.Context, req *http.Request) (schema.State, context.Cont
 
 	uriIndex := 0
 	pathSpec := schema.PathSpec(uriParts[uriIndex])
-	currentModuleID := bootstrapModule.ID()
-	currentRoutersForModule := (*moduleCtx.allRouters)[currentModuleID]
+	currentModuleID := keyOf(bootstrapModule)
+	routers := moduleCtx.routes.snapshot()
+	currentRoutersForModule := routers[currentModuleID]
 	currentRoutersForPathSpec := currentRoutersForModule.pathSpecServFuncListMap[pathSpec]
 	funcIndex := len(currentRoutersForPathSpec) - 1
 
 	pCtx := processContext{
-		moduleCtx:                 moduleCtx,
+		routers:                   routers,
 		currentModuleID:           currentModuleID,
 		currentRoutersForModule:   currentRoutersForModule,
 		currentRoutersForPathSpec: currentRoutersForPathSpec,
@@ -166,6 +274,10 @@ func Process(ctx context.Context, req *http.Request) (schema.State, context.Cont
 	}
 	ctx = context.WithValue(ctx, processContextKey, pctxStack)
 
+	// Expose path parameters to the PathParam helpers
+	params := pctxStack[len(pctxStack)-1].PathParameters()
+	ctx = context.WithValue(ctx, pathVariablesKey, &params)
+
 	return state, ctx, err
 
 }
@@ -212,12 +324,10 @@ func stateReduce(state schema.State, req *http.Request,
 		return pctxStack, state, nil
 	}
 
-	uriFrag := schema.PathSpec(pctx.uriParts[currentUriIndex])
-
 	for currentFuncIndex := pctx.funcIndex; currentFuncIndex >= 0; currentFuncIndex-- {
 		nextModuleID := pctx.currentRoutersForPathSpec[currentFuncIndex].id
-		routersForModule := (*pctx.moduleCtx.allRouters)[nextModuleID]
-		servFuncList := routersForModule.pathSpecServFuncListMap[uriFrag]
+		routersForModule := pctx.routers[nextModuleID]
+		servFuncList, consumed, params := routersForModule.match(pctx.uriParts, currentUriIndex)
 
 		funcIndex := len(servFuncList) - 1
 		if funcIndex >= 0 {
@@ -225,7 +335,8 @@ func stateReduce(state schema.State, req *http.Request,
 			pctx.currentRoutersForModule = routersForModule
 			pctx.currentRoutersForPathSpec = servFuncList
 			pctx.funcIndex = funcIndex
-			pctx.uriIndex = currentUriIndex
+			pctx.uriIndex = currentUriIndex + consumed - 1
+			pctx.pathParams = pctx.withPathParams(params)
 
 			return stateReduce(state, req, pctx, pctxStack)
 		}
@@ -246,15 +357,13 @@ func (rctx renderContext) Final() bool {
 }
 
 func (rctx renderContext) PathParameters() map[string]string {
-	return map[string]string{}
+	return processContext(rctx).PathParameters()
 }
 
 func Render(state schema.State, processCtx context.Context, req *http.Request, w http.ResponseWriter) (schema.State, error) {
 
 	var err error
 
-	fmt.Println(req)
-
 	pCtxStack := processCtx.Value(processContextKey).([]processContext)
 	if pCtxStack == nil {
 		panic(fmt.Errorf("Render called without a process context"))
@@ -1,20 +1,82 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/rovarghe/mule/internal/builtin"
+	"github.com/rovarghe/mule/plugin"
+	"github.com/rovarghe/mule/schema"
 	"github.com/rovarghe/mule/test"
 )
 
 func TestNewPathSpec(t *testing.T) {
 	ps := newPathSpec("foo/bar")
 
-	test.Asserte(t, len(ps.pathArgs) == 0, "Unexpected parameters")
+	test.Asserte(t, len(ps.segments) == 2 && ps.segments[0].param == nil && ps.segments[1].param == nil, "Unexpected parameters")
 
 	ps = newPathSpec("foo/{bar}")
 
-	test.Asserte(t, len(ps.pathArgs) == 1, "Expecting 1 parameter")
+	test.Asserte(t, ps.segments[0].literal == "foo" && ps.segments[1].param != nil && ps.segments[1].param.name == "bar", "Expecting parameter bar")
 	fmt.Printf("%v\n", ps)
 
 }
+
+func TestPathSpecMatch(t *testing.T) {
+	ps := newPathSpec("users/{id:[0-9]+}")
+
+	test.Asserte(t, ps.segments[1].param.regex == "[0-9]+", "Unexpected regex %s", ps.segments[1].param.regex)
+
+	trie := newRouteTrie([]pathSpec{ps})
+	spec, _, params := trie.match([]string{"users", "42"}, 0)
+	test.Asserte(t, spec != nil && params["id"] == "42", "Expecting id=42, got %v", params)
+
+	spec, _, _ = trie.match([]string{"users", "abc"}, 0)
+	test.Asserte(t, spec == nil, "Should not match non-numeric id")
+}
+
+var usersModule = schema.Module{
+	Plugin: plugin.NewPlugin("users", plugin.Version{Major: 1}, []plugin.Dependency{
+		plugin.Dependency{
+			ID:    builtin.CoreModule.ID(),
+			Range: plugin.Range{Minimum: plugin.Version{Major: 1}, Maximum: plugin.Version{Major: 2}, MinInclusive: true},
+		},
+	}),
+	Starter: schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		routers := base.Get(builtin.CoreModule.ID()).Default()
+		routers.AddRoute("users/{id:[0-9]+}",
+			func(state schema.State, ctx schema.ReducerContext, r *http.Request, parent schema.DefaultStateReducer) (schema.State, error) {
+				return ctx.PathParameters(), nil
+			}, nil)
+		routers.AddRoute("users",
+			func(state schema.State, ctx schema.ReducerContext, r *http.Request, parent schema.DefaultStateReducer) (schema.State, error) {
+				return "all users", nil
+			}, nil)
+		return ctx, nil
+	}),
+}
+
+func TestProcessPathParameters(t *testing.T) {
+	loadingCtx, err := LoadModules(context.Background(), append(onlyCoreModule(), usersModule))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, processCtx, err := Process(loadingCtx, httptest.NewRequest("GET", "/users/42", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := state.(map[string]string)
+	test.Asserte(t, params["id"] == "42", "Expecting id=42 in state, got %v", state)
+	test.Asserte(t, PathParam(processCtx, "id") == "42", "Expecting id=42 in context, got %s", PathParam(processCtx, "id"))
+
+	state, _, _ = Process(loadingCtx, httptest.NewRequest("GET", "/users", nil))
+	test.Asserte(t, state == "all users", "Plain path spec should match, got %v", state)
+
+	state, _, _ = Process(loadingCtx, httptest.NewRequest("GET", "/users/abc", nil))
+	_, notFound := state.(notFoundType)
+	test.Asserte(t, notFound, "Expecting not found, got %v", state)
+}
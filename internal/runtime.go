@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/rovarghe/mule/loader"
+	"github.com/rovarghe/mule/plugin"
+	"github.com/rovarghe/mule/schema"
+)
+
+type (
+	// moduleSet is what LoadModules loaded, as changed since by InstallModule, RemoveModule,
+	// UpgradeModule and RestartModule
+	moduleSet struct {
+		// mu lets one change happen at a time
+		mu      sync.Mutex
+		modules []schema.Module
+		loaded  *loader.LoadedPlugins
+		// opts are the options given to LoadModules, used again for every change
+		opts []loader.Option
+
+		// contexts are the contexts returned by the Starter of each running module, passed
+		// on to its dependents when they are started again. ctxMu guards them, as modules
+		// may be started concurrently.
+		ctxMu    sync.Mutex
+		contexts map[moduleKey]context.Context
+	}
+)
+
+// started records the context returned by the Starter of a module
+func (set *moduleSet) started(key moduleKey, ctx context.Context) {
+	if ctx == nil {
+		return
+	}
+	set.ctxMu.Lock()
+	defer set.ctxMu.Unlock()
+	if set.contexts == nil {
+		set.contexts = map[moduleKey]context.Context{}
+	}
+	set.contexts[key] = ctx
+}
+
+// stopped forgets the context of a module that stopped
+func (set *moduleSet) stopped(key moduleKey) {
+	set.ctxMu.Lock()
+	defer set.ctxMu.Unlock()
+	delete(set.contexts, key)
+}
+
+// contextOf returns ctx with the values of the context returned by the Starter of a running module
+func (set *moduleSet) contextOf(key moduleKey, ctx context.Context) context.Context {
+	set.ctxMu.Lock()
+	defer set.ctxMu.Unlock()
+	if values, ok := set.contexts[key]; ok {
+		// Passed on in the change, without the deadline of the start it came from
+		return loader.Detached(ctx, values)
+	}
+	return ctx
+}
+
+// loadOptions are the options given to loader.Load for the modules. Modules in running are
+// already started, they are logged by neither startModule nor the moduleLogger.
+func (set *moduleSet) loadOptions(running map[moduleKey]bool, rollback loader.UnregisterFunc) []loader.Option {
+	opts := []loader.Option{loader.WithObserver(moduleLogger{running: running})}
+	opts = append(opts, set.opts...)
+	return append(opts, loader.WithRollback(rollback))
+}
+
+func loadedModules(ctx context.Context) (moduleLoadingContext, error) {
+	mCtx, ok := ctx.Value(moduleCtxKey).(moduleLoadingContext)
+	if !ok || mCtx.modules.loaded == nil {
+		return mCtx, errors.New("No modules loaded, call LoadModules first")
+	}
+	return mCtx, nil
+}
+
+// InstallModule starts a module while the modules loaded by LoadModules keep serving.
+// Its dependencies must be loaded already. Modules linked differently once it is installed,
+// such as those that depend on a module it replaces, are restarted with their dependents.
+func InstallModule(ctx context.Context, module schema.Module) error {
+	mCtx, err := loadedModules(ctx)
+	if err != nil {
+		return err
+	}
+	set := mCtx.modules
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for _, m := range set.modules {
+		if keyOf(m) == keyOf(module) {
+			return fmt.Errorf("Module %s %s is already installed", module.ID(), module.Version())
+		}
+	}
+	return reload(ctx, mCtx, append(append([]schema.Module{}, set.modules...), module), nil)
+}
+
+// RemoveModule stops every version of the module with the ID and removes its routes, while
+// the other modules keep serving. Modules that optionally depend on it are restarted without
+// it, it cannot be removed while other modules require it.
+func RemoveModule(ctx context.Context, id plugin.ID) error {
+	mCtx, err := loadedModules(ctx)
+	if err != nil {
+		return err
+	}
+	set := mCtx.modules
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	var modules = []schema.Module{}
+	for _, m := range set.modules {
+		if m.ID() != id {
+			modules = append(modules, m)
+		}
+	}
+	if len(modules) == len(set.modules) {
+		return fmt.Errorf("Module %s is not installed", id)
+	}
+	return reload(ctx, mCtx, modules, nil)
+}
+
+// UpgradeModule swaps every version of the module with the same ID for the module, while the
+// other modules keep serving. The module is restarted even if its version did not change,
+// along with the modules that depend on it.
+func UpgradeModule(ctx context.Context, module schema.Module) error {
+	mCtx, err := loadedModules(ctx)
+	if err != nil {
+		return err
+	}
+	set := mCtx.modules
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	var modules = []schema.Module{}
+	for _, m := range set.modules {
+		if m.ID() != module.ID() {
+			modules = append(modules, m)
+		}
+	}
+	if len(modules) == len(set.modules) {
+		return fmt.Errorf("Module %s is not installed", module.ID())
+	}
+	return reload(ctx, mCtx, append(modules, module), map[plugin.ID]bool{module.ID(): true})
+}
+
+// RestartModule stops the module with the ID and every module that depends on it, directly or
+// not, dependents first. It then starts them again in order of their dependencies, so that their
+// routes are added again, while the other modules keep serving.
+func RestartModule(ctx context.Context, id plugin.ID) error {
+	mCtx, err := loadedModules(ctx)
+	if err != nil {
+		return err
+	}
+	set := mCtx.modules
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if !set.isLoaded(id) {
+		return fmt.Errorf("Module %s is not loaded", id)
+	}
+	return reload(ctx, mCtx, set.modules, map[plugin.ID]bool{id: true})
+}
+
+func (set *moduleSet) isLoaded(id plugin.ID) bool {
+	for i := 0; i < set.loaded.Count(); i++ {
+		if set.loaded.Get(i).Plugin().ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// reload changes the running modules to modules, restarting those in restart and any that
+// would not be loaded the same way, with all their dependents. Nothing changes if the modules
+// cannot be loaded together.
+//
+// The routes of the modules to stop are withdrawn and published before any of them stops, so
+// that no request reaches a module that is stopping. The routes of the modules started are
+// only published once all of them started. If a module fails to start, the modules started are
+// stopped again and the ones stopped are started again as they were. Should that fail too, only
+// the modules kept running stay loaded.
+func reload(ctx context.Context, mCtx moduleLoadingContext, modules []schema.Module, restart map[plugin.ID]bool) error {
+	set := mCtx.modules
+	plan, err := loader.Plan(pluginsOf(modules), set.opts...)
+	if err != nil {
+		return err
+	}
+	running := unchanged(set.loaded, plan, restart)
+	ctx = context.WithValue(ctx, moduleCtxKey, mCtx)
+
+	stopping := func(lp *loader.LoadedPlugin) bool {
+		return !running[keyOf(lp.Plugin())]
+	}
+	for i := 0; i < set.loaded.Count(); i++ {
+		if lp := set.loaded.Get(i); stopping(lp) {
+			withdrawModule(mCtx, lp)
+		}
+	}
+	mCtx.routes.publish()
+
+	// Dependents first, the reverse of the order they were started in
+	var stopErrs ShutdownError
+	_, errs := set.loaded.UnloadWhere(ctx, stopping, stopModule)
+	for _, e := range errs {
+		stopErrs = append(stopErrs, ModuleError{ID: e.Plugin.ID(), Version: e.Plugin.Version(), Err: e.Err})
+	}
+
+	previousOrder := mCtx.routes.setOrder(plan)
+	loaded, err := startModules(ctx, set, modules, running)
+	if err != nil {
+		log.Println("Module change failed, restoring modules,", err)
+		mCtx.routes.restoreOrder(previousOrder)
+		restored, restoreErr := startModules(ctx, set, set.modules, running)
+		if restoreErr == nil {
+			modules, loaded = set.modules, restored
+		} else {
+			log.Println("Restoring modules failed,", restoreErr)
+			// Only the modules kept running are left, as they were loaded before the change
+			modules, loaded = nil, set.loaded
+			for _, m := range set.modules {
+				if running[keyOf(m)] {
+					modules = append(modules, m)
+				}
+			}
+			err = fmt.Errorf("%v, restoring the modules stopped failed too: %v", err, restoreErr)
+		}
+	}
+
+	mCtx.routes.publish()
+	set.modules, set.loaded = modules, loaded
+	// The modules kept running are stopped like any other from now on, see moduleLogger
+	for key := range running {
+		delete(running, key)
+	}
+
+	if err != nil {
+		return err
+	}
+	if len(stopErrs) > 0 {
+		return stopErrs
+	}
+	return nil
+}
+
+// startModules loads the modules, starting all but those already running. The dependents of
+// a running module are given the context its Starter returned.
+func startModules(ctx context.Context, set *moduleSet, modules []schema.Module, running map[moduleKey]bool) (*loader.LoadedPlugins, error) {
+	start := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		if running[keyOf(lp.Plugin())] {
+			return set.contextOf(keyOf(lp.Plugin()), ctx), nil
+		}
+		return startModule(ctx, lp)
+	}
+	rollback := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		if running[keyOf(lp.Plugin())] {
+			return ctx, nil
+		}
+		return unloadModule(ctx, lp)
+	}
+	_, loaded, err := loader.Load(ctx, pluginsOf(modules), start, set.loadOptions(running, rollback)...)
+	return loaded, err
+}
+
+// unchanged finds the loaded modules that can keep running with the plan: the same version
+// is loaded, it is not to be restarted, and its dependencies are linked to the same modules,
+// which are unchanged too
+func unchanged(loaded *loader.LoadedPlugins, plan *loader.LoadPlan, restart map[plugin.ID]bool) map[moduleKey]bool {
+	var current = map[moduleKey]*loader.LoadedPlugin{}
+	for i := 0; i < loaded.Count(); i++ {
+		current[keyOf(loaded.Get(i).Plugin())] = loaded.Get(i)
+	}
+
+	var links = map[moduleKey]map[plugin.Dependency]moduleKey{}
+	for _, l := range plan.Links {
+		if links[keyOf(l.Plugin)] == nil {
+			links[keyOf(l.Plugin)] = map[plugin.Dependency]moduleKey{}
+		}
+		links[keyOf(l.Plugin)][l.Dependency] = keyOf(l.Provider)
+	}
+
+	var running = map[moduleKey]bool{}
+	// In order of dependencies, so that the dependencies of a module are decided first
+	for _, p := range plan.Order {
+		key := keyOf(p)
+		lp, ok := current[key]
+		if !ok || restart[p.ID()] || len(lp.Dependencies()) != len(links[key]) {
+			continue
+		}
+		same := true
+		for d, dn := range lp.Dependencies() {
+			if provider, ok := links[key][d]; !ok || provider != keyOf(dn.Plugin()) || !running[provider] {
+				same = false
+			}
+		}
+		running[key] = same
+	}
+	return running
+}
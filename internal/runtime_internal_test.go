@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rovarghe/mule/internal/builtin"
+	"github.com/rovarghe/mule/loader"
+	"github.com/rovarghe/mule/plugin"
+	"github.com/rovarghe/mule/schema"
+	"github.com/rovarghe/mule/test"
+)
+
+// teaModule serves spec under core, answering 418 with its version
+func teaModule(id plugin.ID, version plugin.Version, spec schema.PathSpec, stopped *[]plugin.ID, deps ...plugin.ID) schema.Module {
+	m := recordingModule(id, stopped, nil, append([]plugin.ID{builtin.CoreModule.ID()}, deps...)...)
+	m.Plugin = plugin.NewPlugin(id, version, m.Dependencies())
+	m.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		base.Get(builtin.CoreModule.ID()).Default().AddRoute(spec,
+			func(state schema.State, ctx schema.ReducerContext, r *http.Request, parent schema.DefaultStateReducer) (schema.State, error) {
+				return nil, schema.HTTPError{Code: http.StatusTeapot, Message: string(id) + " " + version.String()}
+			}, nil)
+		return ctx, nil
+	})
+	return m
+}
+
+func get(h http.Handler, uri string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", uri, strings.NewReader("")))
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+func TestInstallModule(t *testing.T) {
+	var stopped []plugin.ID
+	ctx, err := LoadModules(context.Background(), onlyCoreModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+
+	code, _ := get(h, "/tea")
+	test.Asserte(t, code != http.StatusTeapot, "Expected nothing to serve before install, got %d", code)
+
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	if err := InstallModule(ctx, pot); err != nil {
+		t.Fatal(err)
+	}
+	code, body := get(h, "/tea")
+	test.Asserte(t, code == http.StatusTeapot && body == "pot 1.0.0", "Expected the installed module to serve, got %d %s", code, body)
+
+	err = InstallModule(ctx, pot)
+	test.Asserte(t, err != nil, "Expecting an error installing the same module twice")
+
+	// Nothing is started if the dependencies are missing
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "saucer")
+	err = InstallModule(ctx, cup)
+	test.Asserte(t, err != nil, "Expecting an error installing a module without its dependencies")
+	code, _ = get(h, "/cup")
+	test.Asserte(t, code != http.StatusTeapot, "Expected nothing to serve, got %d", code)
+	test.Asserte(t, len(stopped) == 0, "No module should be stopped, got %v", stopped)
+}
+
+func TestUpgradeModule(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	saucer := teaModule("saucer", plugin.Version{Major: 1}, "saucer", &stopped)
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup, saucer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+	before := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()
+
+	if err := UpgradeModule(ctx, teaModule("pot", plugin.Version{Major: 1, Minor: 1}, "tea", &stopped)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dependent is restarted, the others keep running
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"cup", "pot"}), "Unexpected modules stopped %v", stopped)
+	code, body := get(h, "/tea")
+	test.Asserte(t, code == http.StatusTeapot && body == "pot 1.1.0", "Expected the new version to serve, got %d %s", code, body)
+	code, body = get(h, "/cup")
+	test.Asserte(t, code == http.StatusTeapot && body == "cup 1.0.0", "Expected the dependent to serve again, got %d %s", code, body)
+	code, _ = get(h, "/saucer")
+	test.Asserte(t, code == http.StatusTeapot, "Expected the unrelated module to keep serving, got %d", code)
+
+	// The table requests in flight were served from is unchanged
+	coreRoutes := before[keyOf(builtin.CoreModule)].pathSpecServFuncListMap
+	test.Asserte(t, len(coreRoutes["tea"]) == 1 && coreRoutes["tea"][0].id == keyOf(pot),
+		"Expecting the old table to keep the old version, got %v", coreRoutes["tea"])
+
+	err = UpgradeModule(ctx, teaModule("kettle", plugin.Version{Major: 1}, "kettle", &stopped))
+	test.Asserte(t, err != nil, "Expecting an error upgrading a module that is not installed")
+}
+
+func TestRemoveModule(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+
+	err = RemoveModule(ctx, "pot")
+	test.Asserte(t, err != nil, "Expecting an error removing a module another one requires")
+	test.Asserte(t, len(stopped) == 0, "No module should be stopped, got %v", stopped)
+
+	if err := RemoveModule(ctx, "cup"); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"cup"}), "Unexpected modules stopped %v", stopped)
+	code, _ := get(h, "/cup")
+	test.Asserte(t, code != http.StatusTeapot, "Expected nothing to serve once removed, got %d", code)
+	code, _ = get(h, "/tea")
+	test.Asserte(t, code == http.StatusTeapot, "Expected the other module to keep serving, got %d", code)
+
+	// Unloading stops what is left
+	stopped = nil
+	if _, err := UnloadModules(ctx); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"pot"}), "Unexpected modules stopped %v", stopped)
+}
+
+func TestUpgradeModuleFailure(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+
+	broken := teaModule("pot", plugin.Version{Major: 1, Minor: 1}, "tea", &stopped)
+	broken.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		return ctx, errors.New("cannot start")
+	})
+	err = UpgradeModule(ctx, broken)
+	test.Asserte(t, err != nil, "Expecting the upgrade to fail")
+
+	// The old version is started again, with its dependent
+	code, body := get(h, "/tea")
+	test.Asserte(t, code == http.StatusTeapot && body == "pot 1.0.0", "Expected the old version to serve, got %d %s", code, body)
+	code, _ = get(h, "/cup")
+	test.Asserte(t, code == http.StatusTeapot, "Expected the dependent to serve again, got %d", code)
+
+	stopped = nil
+	UnloadModules(ctx)
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"cup", "pot"}), "Unexpected modules stopped %v", stopped)
+}
+
+func TestUpgradeModuleRestoreFailure(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	potStart, starts := pot.Starter, 0
+	pot.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		// Cannot start again once stopped
+		if starts++; starts > 1 {
+			return ctx, errors.New("cannot start again")
+		}
+		return potStart.Start(ctx, base)
+	})
+	saucer := teaModule("saucer", plugin.Version{Major: 1}, "saucer", &stopped)
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, saucer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+
+	broken := teaModule("pot", plugin.Version{Major: 1, Minor: 1}, "tea", &stopped)
+	broken.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		return ctx, errors.New("cannot start")
+	})
+	err = UpgradeModule(ctx, broken)
+	test.Asserte(t, err != nil && strings.Contains(err.Error(), "cannot start again"), "Expecting the upgrade and the restore to fail, got %v", err)
+
+	// The modules kept running are still loaded, and still stopped at the end
+	code, _ := get(h, "/saucer")
+	test.Asserte(t, code == http.StatusTeapot, "Expected saucer to serve, got %d", code)
+	code, _ = get(h, "/tea")
+	test.Asserte(t, code != http.StatusTeapot, "Expected pot not to serve, got %d", code)
+	set := ctx.Value(moduleCtxKey).(moduleLoadingContext).modules
+	test.Asserte(t, set.isLoaded(builtin.CoreModule.ID()) && set.isLoaded("saucer") && !set.isLoaded("pot"),
+		"Expecting core and saucer to be loaded, got %v", set.loaded)
+	test.Asserte(t, len(set.modules) == 2, "Expecting core and saucer as the modules, got %v", set.modules)
+
+	stopped = nil
+	UnloadModules(ctx)
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"saucer"}), "Unexpected modules stopped %v", stopped)
+}
+
+func TestUpgradeModuleWhileServing(t *testing.T) {
+	var stopped []plugin.ID
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// pot is not served while it is upgraded, but an older version never serves again
+			// once a newer one did
+			last := ""
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if code, body := get(h, "/tea"); code == http.StatusTeapot {
+					if len(body) < len(last) || len(body) == len(last) && body < last {
+						t.Errorf("Expected %s or later to serve, got %s", last, body)
+						return
+					}
+					last = body
+				}
+			}
+		}()
+	}
+
+	for minor := 1; minor <= 20; minor++ {
+		if err := UpgradeModule(ctx, teaModule("pot", plugin.Version{Major: 1, Minor: minor}, "tea", &stopped)); err != nil {
+			t.Error(err)
+		}
+		version := plugin.Version{Major: 1, Minor: minor}.String()
+		code, body := get(h, "/tea")
+		test.Asserte(t, code == http.StatusTeapot && body == "pot "+version, "Expected pot %s to serve once upgraded, got %d %s", version, code, body)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRestartModule(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	spoon := teaModule("spoon", plugin.Version{Major: 1}, "spoon", &stopped, "cup")
+	saucer := teaModule("saucer", plugin.Version{Major: 1}, "saucer", &stopped)
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup, spoon, saucer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+
+	if err := RestartModule(ctx, "cup"); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(stopped, []plugin.ID{"spoon", "cup"}), "Expecting cup and its dependents to stop, got %v", stopped)
+	for _, uri := range []string{"/tea", "/cup", "/spoon", "/saucer"} {
+		code, _ := get(h, uri)
+		test.Asserte(t, code == http.StatusTeapot, "Expected %s to be served after the restart, got %d", uri, code)
+	}
+
+	// Routes are not duplicated by the restart
+	coreRoutes := ctx.Value(moduleCtxKey).(moduleLoadingContext).routes.snapshot()[keyOf(builtin.CoreModule)].pathSpecServFuncListMap
+	test.Asserte(t, len(coreRoutes["cup"]) == 1 && len(coreRoutes["spoon"]) == 1, "Expecting one route each, got %v", coreRoutes)
+
+	err = RestartModule(ctx, "kettle")
+	test.Asserte(t, err != nil, "Expecting an error restarting a module that is not loaded")
+}
+
+func TestRestartModuleStopsServing(t *testing.T) {
+	var h *Handler
+	var reached []string
+	// closingModule serves spec until its Stopper closes it, the Stopper then requests the
+	// routes of the module and its dependents, none of which may be served any longer
+	closingModule := func(id plugin.ID, spec schema.PathSpec, uris []string, deps ...plugin.ID) schema.Module {
+		var stopped []plugin.ID
+		m := teaModule(id, plugin.Version{Major: 1}, spec, &stopped, deps...)
+		closed := false
+		m.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+			closed = false
+			base.Get(builtin.CoreModule.ID()).Default().AddRoute(spec,
+				func(state schema.State, ctx schema.ReducerContext, r *http.Request, parent schema.DefaultStateReducer) (schema.State, error) {
+					if closed {
+						reached = append(reached, r.URL.Path)
+						return nil, errors.New(string(id) + " is closed")
+					}
+					return nil, schema.HTTPError{Code: http.StatusTeapot, Message: string(id)}
+				}, nil)
+			return ctx, nil
+		})
+		m.Stopper = schema.StopperFunc(func(ctx context.Context) (context.Context, error) {
+			closed = true
+			for _, uri := range uris {
+				get(h, uri)
+			}
+			return ctx, nil
+		})
+		return m
+	}
+	pot := closingModule("pot", "tea", []string{"/tea", "/cup"})
+	cup := closingModule("cup", "cup", []string{"/cup"}, "pot")
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = NewHandler(ctx)
+
+	if err := RestartModule(ctx, "pot"); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, len(reached) == 0, "Expecting no request to reach a stopped module, got %v", reached)
+	for _, uri := range []string{"/tea", "/cup"} {
+		code, _ := get(h, uri)
+		test.Asserte(t, code == http.StatusTeapot, "Expected %s to be served after the restart, got %d", uri, code)
+	}
+}
+
+type potCtxKeyType string
+
+func TestRestartModuleContext(t *testing.T) {
+	var stopped []plugin.ID
+	var brews []interface{}
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	potStart := pot.Starter
+	pot.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		ctx, err := potStart.Start(ctx, base)
+		return context.WithValue(ctx, potCtxKeyType("brew"), "oolong"), err
+	})
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	cupStart := cup.Starter
+	cup.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+		brews = append(brews, ctx.Value(potCtxKeyType("brew")))
+		return cupStart.Start(ctx, base)
+	})
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dependent is given what the running module's Starter added, even if the context the
+	// restart is asked with does not have it
+	restartCtx := context.WithValue(context.Background(), moduleCtxKey, ctx.Value(moduleCtxKey))
+	if err := RestartModule(restartCtx, "cup"); err != nil {
+		t.Fatal(err)
+	}
+	test.Asserte(t, reflect.DeepEqual(brews, []interface{}{"oolong", "oolong"}), "Expecting cup to see the brew each time, got %v", brews)
+}
+
+// stopRecorder is an Observer that records the modules stopping
+type stopRecorder struct {
+	loader.DefaultObserver
+	stopping []plugin.ID
+	errs     []error
+}
+
+func (r *stopRecorder) Stopping(lp *loader.LoadedPlugin) {
+	r.stopping = append(r.stopping, lp.Plugin().ID())
+}
+
+func (r *stopRecorder) Stopped(lp *loader.LoadedPlugin, elapsed time.Duration, err error) {
+	r.errs = append(r.errs, err)
+}
+
+func TestRestartModuleStopTimeout(t *testing.T) {
+	var stopped []plugin.ID
+	pot := teaModule("pot", plugin.Version{Major: 1}, "tea", &stopped)
+	cup := teaModule("cup", plugin.Version{Major: 1}, "cup", &stopped, "pot")
+	cup.Stopper = schema.StopperFunc(func(ctx context.Context) (context.Context, error) {
+		<-ctx.Done()
+		return ctx, nil
+	})
+	var r stopRecorder
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot, cup),
+		loader.WithStopTimeout(20*time.Millisecond), loader.WithObserver(&r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(ctx)
+
+	// Stops go through the loader, with its timeouts and observers
+	err = RestartModule(ctx, "pot")
+	shutdownErr, ok := err.(ShutdownError)
+	var timeoutErr loader.TimeoutError
+	test.Asserte(t, ok && len(shutdownErr) == 1 && shutdownErr[0].ID == "cup" && errors.As(shutdownErr[0].Err, &timeoutErr),
+		"Expecting cup to time out, got %v", err)
+	test.Asserte(t, reflect.DeepEqual(r.stopping, []plugin.ID{"cup", "pot"}), "Expecting observers to see cup and pot stop, got %v", r.stopping)
+	test.Asserte(t, len(r.errs) == 2 && errors.As(r.errs[0], &timeoutErr), "Expecting observers to see the timeout, got %v", r.errs)
+
+	// Both are started again regardless
+	for _, uri := range []string{"/tea", "/cup"} {
+		code, _ := get(h, uri)
+		test.Asserte(t, code == http.StatusTeapot, "Expected %s to be served after the restart, got %d", uri, code)
+	}
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rovarghe/mule/loader"
+	"github.com/rovarghe/mule/schema"
+)
+
+// routeTable holds the routes of every module. Modules add and withdraw routes on a draft,
+// while requests are served from the last published copy of it. A published copy is never
+// changed, so a request sees one consistent table from Process to Render, however the
+// modules change in the meantime.
+type routeTable struct {
+	// mu guards the draft, modules may be started concurrently
+	mu        sync.Mutex
+	draft     routersImpl
+	published atomic.Value
+	// order is the position of each module in the order a sequential load starts them. The
+	// routes for a path spec are kept in that order, however concurrently the modules start.
+	order map[moduleKey]int
+}
+
+func newRouteTable(initial routersImpl) *routeTable {
+	t := &routeTable{draft: initial}
+	t.publish()
+	return t
+}
+
+// snapshot returns the published table, to serve a request with
+func (t *routeTable) snapshot() routersImpl {
+	return t.published.Load().(routersImpl)
+}
+
+// update changes the draft, the change is served once published
+func (t *routeTable) update(change func(draft routersImpl)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	change(t.draft)
+}
+
+// setOrder orders the routes added from now on by the plan, see loader.Plan. Returns the
+// order it replaces.
+func (t *routeTable) setOrder(plan *loader.LoadPlan) map[moduleKey]int {
+	order := map[moduleKey]int{}
+	if plan != nil {
+		for i, p := range plan.Order {
+			order[keyOf(p)] = i
+		}
+	}
+	return t.restoreOrder(order)
+}
+
+// restoreOrder puts back an order replaced by setOrder, returning the one it replaces
+func (t *routeTable) restoreOrder(order map[moduleKey]int) map[moduleKey]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	previous := t.order
+	t.order = order
+	return previous
+}
+
+// publish has requests served from the draft as it is now
+func (t *routeTable) publish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.published.Store(t.draft.compile())
+}
+
+// compile copies the table deep enough that routes can be added to and removed from the
+// original without changing the copy, and builds the trie of each module's routers
+func (all routersImpl) compile() routersImpl {
+	copied := routersImpl{}
+	for id, psrl := range all {
+		psfMap := make(map[schema.PathSpec]pluginServeFuncList, len(psrl.pathSpecServFuncListMap))
+		for ps, list := range psrl.pathSpecServFuncListMap {
+			psfMap[ps] = append(pluginServeFuncList{}, list...)
+		}
+		psrl.pathSpecServFuncListMap = psfMap
+		psrl.specs = append([]pathSpec{}, psrl.specs...)
+		psrl.trie = newRouteTrie(psrl.specs)
+		copied[id] = psrl
+	}
+	return copied
+}
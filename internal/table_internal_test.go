@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rovarghe/mule/internal/builtin"
+	"github.com/rovarghe/mule/plugin"
+	"github.com/rovarghe/mule/schema"
+	"github.com/rovarghe/mule/test"
+)
+
+func TestRouteTablePublish(t *testing.T) {
+	table := newRouteTable(routersImpl{})
+	key := keyOf(builtin.CoreModule)
+
+	table.update(func(draft routersImpl) {
+		draft.addRoute(key, "a", pluginServeFunc{id: key, stateReducer: notFoundServeFunc}, nil)
+	})
+	before := table.snapshot()
+	test.Asserte(t, len(before) == 0, "Changes should not be served before they are published, got %v", before)
+
+	table.publish()
+	published := table.snapshot()
+	test.Asserte(t, len(published[key].pathSpecServFuncListMap["a"]) == 1, "Expecting the route once published, got %v", published)
+
+	// Later changes leave the published table alone
+	table.update(func(draft routersImpl) {
+		draft.addRoute(key, "a", pluginServeFunc{id: key, stateReducer: notFoundServeFunc}, nil)
+		draft.addRoute(key, "b/{id}", pluginServeFunc{id: key, stateReducer: notFoundServeFunc}, nil)
+	})
+	test.Asserte(t, len(published[key].pathSpecServFuncListMap["a"]) == 1 && len(published[key].specs) == 1,
+		"The published table should not change, got %v", published)
+	table.publish()
+	test.Asserte(t, len(table.snapshot()[key].pathSpecServFuncListMap["a"]) == 2, "Expecting both routes, got %v", table.snapshot())
+}
+
+func TestAddRouteSameShape(t *testing.T) {
+	draft := routersImpl{}
+	key := keyOf(builtin.CoreModule)
+	psf := pluginServeFunc{id: key, stateReducer: notFoundServeFunc}
+
+	for _, spec := range []schema.PathSpec{"users/{id}", "users/{id:[0-9]+}", "files/{path...}"} {
+		err := draft.addRoute(key, spec, psf, nil)
+		test.Asserte(t, err == nil, "Expecting %s to be added, got %v", spec, err)
+	}
+	// The same path spec can be added again, by another module
+	err := draft.addRoute(key, "users/{id}", psf, nil)
+	test.Asserte(t, err == nil, "Expecting users/{id} to be added again, got %v", err)
+
+	// Only the parameter names differ, the routes would never be matched
+	for _, spec := range []schema.PathSpec{"users/{name}", "users/{n:[0-9]+}", "files/{rest...}"} {
+		err := draft.addRoute(key, spec, psf, nil)
+		test.Asserte(t, err != nil, "Expecting %s to be rejected", spec)
+		_, ok := draft[key].pathSpecServFuncListMap[spec]
+		test.Asserte(t, !ok, "Expecting no route for %s, got %v", spec, draft[key].pathSpecServFuncListMap)
+	}
+	test.Asserte(t, len(draft[key].specs) == 3, "Expecting only the first path specs, got %v", draft[key].specs)
+}
+
+func TestServeWhileChangingRoutes(t *testing.T) {
+	// stops counts the Stoppers begun. Each request is sent with the count, a module it reaches
+	// must not have begun stopping before it was sent.
+	var stops int32
+	var h *Handler
+	serve := func(uri string) {
+		r := httptest.NewRequest("GET", uri, nil)
+		r.Header.Set("X-Stops", strconv.Itoa(int(atomic.LoadInt32(&stops))))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	serving := func(id plugin.ID, spec schema.PathSpec, deps ...plugin.ID) schema.Module {
+		var stopped []plugin.ID
+		m := teaModule(id, plugin.Version{Major: 1}, spec, &stopped, deps...)
+		var stoppedAt int32
+		m.Starter = schema.StarterFunc(func(ctx context.Context, base schema.BaseRouters) (context.Context, error) {
+			atomic.StoreInt32(&stoppedAt, 0)
+			base.Get(builtin.CoreModule.ID()).Default().AddRoute(spec,
+				func(state schema.State, ctx schema.ReducerContext, r *http.Request, parent schema.DefaultStateReducer) (schema.State, error) {
+					sent, _ := strconv.Atoi(r.Header.Get("X-Stops"))
+					if at := atomic.LoadInt32(&stoppedAt); at != 0 && int(at) <= sent {
+						t.Errorf("Request reached %s after it stopped", id)
+					}
+					return nil, schema.HTTPError{Code: http.StatusTeapot, Message: string(id)}
+				}, nil)
+			return ctx, nil
+		})
+		m.Stopper = schema.StopperFunc(func(ctx context.Context) (context.Context, error) {
+			atomic.StoreInt32(&stoppedAt, atomic.AddInt32(&stops, 1))
+			// Its route is no longer served
+			serve("/" + string(spec))
+			return ctx, nil
+		})
+		return m
+	}
+	pot := serving("pot", "tea")
+	cup := serving("cup", "cup", "pot")
+	ctx, err := LoadModules(context.Background(), append(onlyCoreModule(), pot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = NewHandler(ctx)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, uri := range []string{"/tea", "/cup", "/tea", "/cup"} {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				serve(uri)
+			}
+		}(uri)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := InstallModule(ctx, cup); err != nil {
+			t.Error(err)
+		}
+		if err := RestartModule(ctx, "pot"); err != nil {
+			t.Error(err)
+		}
+		if err := RemoveModule(ctx, "cup"); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
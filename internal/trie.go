@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"strings"
+)
+
+type (
+	// routeTrie matches URI parts against the path specs of a module's routers, one URI part
+	// at a time, so that the cost of a match depends on the length of the URI rather than on
+	// the number of routes. Parameters that match the same URI parts share an edge whatever
+	// their names, which are only looked up in the path spec matched.
+	//
+	// The path spec that consumes the most URI parts is matched. Among those consuming as many,
+	// literal parts take precedence over parameters, from left to right, and parameters are
+	// tried in the order they were added. A catch-all parameter takes the rest of the URI, it is
+	// used unless another path spec consumes more URI parts than precede it. Of several
+	// catch-alls, the one after the longest prefix wins.
+	routeTrie struct {
+		root trieNode
+	}
+
+	trieNode struct {
+		// spec is the path spec ending at the node, if any
+		spec     *pathSpec
+		literals map[string]*trieNode
+		params   []paramEdge
+		// catchAll is the first path spec with a catch-all parameter at the node
+		catchAll *pathSpec
+	}
+
+	// paramEdge is taken by the URI parts that the parameters with its predicate match
+	paramEdge struct {
+		predicate string
+		param     pathParameter
+		node      *trieNode
+	}
+
+	// trieMatch is a path spec found by routeTrie.match
+	trieMatch struct {
+		spec     *pathSpec
+		consumed int
+		params   map[string]string
+	}
+)
+
+func newRouteTrie(specs []pathSpec) *routeTrie {
+	t := &routeTrie{}
+	for i := range specs {
+		t.insert(&specs[i])
+	}
+	return t
+}
+
+func (t *routeTrie) insert(spec *pathSpec) {
+	n := &t.root
+	for _, segment := range spec.segments {
+		switch {
+		case segment.param == nil:
+			if n.literals == nil {
+				n.literals = map[string]*trieNode{}
+			}
+			next, ok := n.literals[segment.literal]
+			if !ok {
+				next = &trieNode{}
+				n.literals[segment.literal] = next
+			}
+			n = next
+		case segment.param.catchAll:
+			if n.catchAll == nil {
+				n.catchAll = spec
+			}
+			return
+		default:
+			n = n.paramNode(*segment.param)
+		}
+	}
+	if n.spec == nil {
+		n.spec = spec
+	}
+}
+
+// paramNode returns the node after the parameter, parameters with the same predicate share it
+func (n *trieNode) paramNode(param pathParameter) *trieNode {
+	for _, edge := range n.params {
+		if edge.predicate == param.predicate() {
+			return edge.node
+		}
+	}
+	edge := paramEdge{predicate: param.predicate(), param: param, node: &trieNode{}}
+	n.params = append(n.params, edge)
+	return edge.node
+}
+
+// match finds the path spec for the URI parts beginning at index i. Returns nil if none
+// matches, or the path spec, the number of URI parts consumed and the path parameters captured.
+func (t *routeTrie) match(uriParts []string, i int) (*pathSpec, int, map[string]string) {
+	var best, fallback trieMatch
+	// fallbackPrefix is the number of URI parts before the catch-all of fallback
+	var fallbackPrefix int
+
+	// values are the URI parts taken by parameters on the way to n
+	var walk func(n *trieNode, j int, values []string)
+	walk = func(n *trieNode, j int, values []string) {
+		if n.spec != nil && j-i > best.consumed {
+			best = trieMatch{spec: n.spec, consumed: j - i, params: n.spec.capture(values)}
+		}
+		if j == len(uriParts) {
+			return
+		}
+		if n.catchAll != nil && (fallback.spec == nil || j-i > fallbackPrefix) {
+			params := n.catchAll.capture(values)
+			params[n.catchAll.segments[len(n.catchAll.segments)-1].param.name] = strings.Join(uriParts[j:], "/")
+			fallback = trieMatch{spec: n.catchAll, consumed: len(uriParts) - i, params: params}
+			fallbackPrefix = j - i
+		}
+
+		part := uriParts[j]
+		if next, ok := n.literals[part]; ok {
+			walk(next, j+1, values)
+		}
+		for _, edge := range n.params {
+			if edge.param.matches(part) {
+				walk(edge.node, j+1, append(values, part))
+			}
+		}
+	}
+	walk(&t.root, i, nil)
+
+	if fallback.spec != nil && (best.spec == nil || fallbackPrefix >= best.consumed) {
+		best = fallback
+	}
+	return best.spec, best.consumed, best.params
+}
+
+// capture names the values of the parameters of the path spec, other than a catch-all,
+// in the order they appear
+func (ps *pathSpec) capture(values []string) map[string]string {
+	params := make(map[string]string, len(values)+1)
+	k := 0
+	for _, segment := range ps.segments {
+		if segment.param != nil && !segment.param.catchAll {
+			params[segment.param.name] = values[k]
+			k++
+		}
+	}
+	return params
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rovarghe/mule/schema"
+	"github.com/rovarghe/mule/test"
+)
+
+func trieOf(paths ...string) *routeTrie {
+	var specs []pathSpec
+	for _, p := range paths {
+		specs = append(specs, newPathSpec(p))
+	}
+	return newRouteTrie(specs)
+}
+
+func TestRouteTrieMatch(t *testing.T) {
+	var table = []struct {
+		paths    []string
+		uri      string
+		expected schema.PathSpec
+		consumed int
+		params   map[string]string
+	}{
+		// The most URI parts consumed wins
+		{[]string{"users", "users/{id}"}, "users/42", "users/{id}", 2, map[string]string{"id": "42"}},
+		{[]string{"users", "users/{id}"}, "users/42/orders", "users/{id}", 2, map[string]string{"id": "42"}},
+		{[]string{"users", "users/{id}"}, "users", "users", 1, map[string]string{}},
+		// Then literals over parameters, from left to right
+		{[]string{"users/{id}", "users/me"}, "users/me", "users/me", 2, map[string]string{}},
+		{[]string{"users/{id}", "users/me"}, "users/7", "users/{id}", 2, map[string]string{"id": "7"}},
+		{[]string{"{kind}/b", "a/{x}"}, "a/b", "a/{x}", 2, map[string]string{"x": "b"}},
+		{[]string{"{id}", "about"}, "about", "about", 1, map[string]string{}},
+		// Then parameters in the order added
+		{[]string{"{n:[0-9]+}", "{name}"}, "7", "{n:[0-9]+}", 1, map[string]string{"n": "7"}},
+		{[]string{"{n:[0-9]+}", "{name}"}, "x", "{name}", 1, map[string]string{"name": "x"}},
+		{[]string{"{name}", "{n:[0-9]+}"}, "7", "{name}", 1, map[string]string{"name": "7"}},
+		// Parameters are named by the path spec matched
+		{[]string{"{a}/x", "{b}/y"}, "1/y", "{b}/y", 2, map[string]string{"b": "1"}},
+		{[]string{"{a}/x", "{b}"}, "1/y", "{b}", 1, map[string]string{"b": "1"}},
+		{[]string{"{a}/x", "{b}/x"}, "1/x", "{a}/x", 2, map[string]string{"a": "1"}},
+		{[]string{"{a}/{rest...}", "{b}/x/{c}"}, "1/x/y/z", "{b}/x/{c}", 3, map[string]string{"b": "1", "c": "y"}},
+		{[]string{"{a}/{rest...}", "{b}/x/{c}"}, "1/y/z", "{a}/{rest...}", 3, map[string]string{"a": "1", "rest": "y/z"}},
+		// Regexes match the whole URI part
+		{[]string{"users/{id:[0-9]+}"}, "users/4a2", "", 0, nil},
+		{[]string{"v{n:[0-9]+}"}, "v1", "", 0, nil},
+		{[]string{"{v:v[0-9]+}/x"}, "v1/x", "{v:v[0-9]+}/x", 2, map[string]string{"v": "v1"}},
+		// Catch-alls take the rest, unless something consumes more than their prefix
+		{[]string{"files", "files/{path...}"}, "files/a/b", "files/{path...}", 3, map[string]string{"path": "a/b"}},
+		{[]string{"files", "files/{path...}"}, "files", "files", 1, map[string]string{}},
+		{[]string{"users", "{rest...}"}, "users/42", "users", 1, map[string]string{}},
+		{[]string{"{rest...}", "users/{id}/{tail...}"}, "users/7/a/b", "users/{id}/{tail...}", 4, map[string]string{"id": "7", "tail": "a/b"}},
+		{[]string{"{rest...}"}, "a/b", "{rest...}", 2, map[string]string{"rest": "a/b"}},
+		{[]string{"about"}, "users", "", 0, nil},
+	}
+
+	for _, r := range table {
+		spec, consumed, params := trieOf(r.paths...).match(strings.Split(r.uri, "/"), 0)
+		var path schema.PathSpec
+		if spec != nil {
+			path = spec.path
+		}
+		test.Asserte(t, path == r.expected && consumed == r.consumed && fmt.Sprint(params) == fmt.Sprint(r.params),
+			"%v on %s: expected %s %d %v, got %s %d %v", r.paths, r.uri, r.expected, r.consumed, r.params, path, consumed, params)
+	}
+
+	// Matching starts at the given URI part
+	spec, consumed, _ := trieOf("orders").match([]string{"", "users", "orders"}, 2)
+	test.Asserte(t, spec != nil && consumed == 1, "Expecting orders to match at index 2, got %v %d", spec, consumed)
+}
+
+func TestNewPathSpecCatchAll(t *testing.T) {
+	ps := newPathSpec("files/{path...}")
+	test.Asserte(t, ps.segments[1].param.catchAll && ps.segments[1].param.name == "path", "Expecting a catch-all, got %v", ps.segments)
+
+	defer func() {
+		test.Asserte(t, recover() != nil, "Expecting a panic for a catch-all that is not last")
+	}()
+	newPathSpec("{path...}/files")
+}
+
+// routes makes n modules' worth of path specs, a mix of literals, parameters and catch-alls
+func routes(n int) []pathSpec {
+	var specs []pathSpec
+	for k := 0; k < n; k++ {
+		specs = append(specs,
+			newPathSpec(fmt.Sprintf("resource%d", k)),
+			newPathSpec(fmt.Sprintf("resource%d/{id:[0-9]+}", k)),
+			newPathSpec(fmt.Sprintf("resource%d/{id:[0-9]+}/items/{item}", k)),
+			newPathSpec(fmt.Sprintf("static%d/{path...}", k)),
+		)
+	}
+	return specs
+}
+
+// paramRoutes makes n path specs beginning with a parameter, each with its own name
+func paramRoutes(n int) []pathSpec {
+	var specs []pathSpec
+	for k := 0; k < n; k++ {
+		specs = append(specs,
+			newPathSpec(fmt.Sprintf("{p%d}/x%d", k, k)),
+			newPathSpec(fmt.Sprintf("{n%d:[0-9]+}/y%d", k, k)),
+		)
+	}
+	return specs
+}
+
+func BenchmarkRouteTrieMatch(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("routes=%d", 4*n), func(b *testing.B) {
+			trie := newRouteTrie(routes(n))
+			uri := strings.Split(fmt.Sprintf("/resource%d/42/items/abc", n-1), "/")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if spec, _, _ := trie.match(uri, 1); spec == nil {
+					b.Fatal("No match")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRouteTrieMatchParams(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("routes=%d", 2*n), func(b *testing.B) {
+			trie := newRouteTrie(paramRoutes(n))
+			uris := [][]string{{"", "abc", "x0"}, {"", "42", fmt.Sprintf("y%d", n-1)}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if spec, _, _ := trie.match(uris[i%2], 1); spec == nil {
+					b.Fatal("No match")
+				}
+			}
+		})
+	}
+}
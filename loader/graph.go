@@ -0,0 +1,201 @@
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+type (
+	// Graph is the dependency graph of LoadedPlugins, see LoadedPlugins.Graph
+	Graph struct {
+		Nodes []GraphNode `json:"nodes"`
+		Edges []GraphEdge `json:"edges"`
+	}
+
+	// GraphNode is a plugin in the Graph. State is the RegistrationState of the plugin, or
+	// GraphUnresolved if its dependencies could not be satisfied, or GraphUnregistered if it was
+	// never registered for another reason. Nodes for missing dependencies have no Plugin.
+	GraphNode struct {
+		ID      string          `json:"id"`
+		Plugin  plugin.ID       `json:"plugin,omitempty"`
+		Version *plugin.Version `json:"version,omitempty"`
+		State   string          `json:"state"`
+	}
+
+	// GraphEdge links a plugin to the plugin satisfying one of its dependencies. An unresolved
+	// plugin is not linked, its edges point to the highest version satisfying each dependency,
+	// or are Missing edges to a node for the dependency if nothing satisfies it.
+	GraphEdge struct {
+		From       string            `json:"from"`
+		To         string            `json:"to"`
+		Dependency plugin.Dependency `json:"dependency"`
+		Missing    bool              `json:"missing,omitempty"`
+	}
+)
+
+// States of a GraphNode besides those of RegistrationState
+const (
+	GraphUnresolved   = "Unresolved"
+	GraphUnregistered = "Unregistered"
+)
+
+// Fill colours of the nodes in WriteDOT, by state
+var dotColors = map[string]string{
+	DependenciesRegistered.String(): "orange",
+	PluginRegistered.String():       "lightblue",
+	DependentsRegistered.String():   "palegreen",
+	PluginShadowed.String():         "gray80",
+	PluginReplaced.String():         "gray90",
+	GraphUnresolved:                 "tomato",
+	GraphUnregistered:               "white",
+}
+
+func (s RegistrationState) String() string {
+	switch s {
+	case DependenciesRegistered:
+		return "DependenciesRegistered"
+	case PluginRegistered:
+		return "PluginRegistered"
+	case DependentsRegistered:
+		return "DependentsRegistered"
+	case PluginShadowed:
+		return "Shadowed"
+	case PluginReplaced:
+		return "Replaced"
+	default:
+		return fmt.Sprintf("RegistrationState(%d)", int(s))
+	}
+}
+
+func nodeID(p plugin.Plugin) string {
+	return fmt.Sprintf("%s@%s", p.ID(), p.Version())
+}
+
+// missingID is the ID of the node for a dependency nothing satisfies
+func missingID(d plugin.Dependency) string {
+	return fmt.Sprintf("missing:%s", d.ID)
+}
+
+// nodeState is the state shown in the graph, the RegistrationState is only meaningful
+// for plugins that were loaded, shadowed or replaced
+func (state *LoadedPlugins) nodeState(n *LoadedPlugin) string {
+	switch {
+	case state.unresolved[n] != nil:
+		return GraphUnresolved
+	case n.state == PluginShadowed || n.state == PluginReplaced || state.loaded.contains(n):
+		return n.state.String()
+	default:
+		return GraphUnregistered
+	}
+}
+
+// Graph returns every plugin given to Load, and the links between them. Nodes are sorted
+// by plugin ID, then version. Edges follow the order of the nodes, then of the dependencies.
+func (state *LoadedPlugins) Graph() Graph {
+	var nodes = pluginList{}
+	for _, versions := range state.all {
+		nodes = append(nodes, versions...)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i].plugin, nodes[j].plugin
+		if a.ID() != b.ID() {
+			return a.ID() < b.ID()
+		}
+		return a.Version().Compare(b.Version()) < 0
+	})
+
+	var g = Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	var missing = map[string]bool{}
+	for _, n := range nodes {
+		nodeState := state.nodeState(n)
+		version := n.plugin.Version()
+		g.Nodes = append(g.Nodes, GraphNode{
+			ID:      nodeID(n.plugin),
+			Plugin:  n.plugin.ID(),
+			Version: &version,
+			State:   nodeState,
+		})
+		for _, d := range n.plugin.Dependencies() {
+			if dn, ok := n.dependencies[d]; ok {
+				g.Edges = append(g.Edges, GraphEdge{From: nodeID(n.plugin), To: nodeID(dn.plugin), Dependency: d})
+			} else if nodeState == GraphUnresolved && !d.Optional {
+				edge := GraphEdge{From: nodeID(n.plugin), To: missingID(d), Dependency: d, Missing: true}
+				for _, dn := range nodes {
+					// Sorted by version, so the last one is the highest
+					if plugin.Satisfies(dn.plugin, d) {
+						edge.To, edge.Missing = nodeID(dn.plugin), false
+					}
+				}
+				if edge.Missing {
+					missing[edge.To] = true
+				}
+				g.Edges = append(g.Edges, edge)
+			}
+		}
+	}
+
+	var ids = []string{}
+	for id := range missing {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		g.Nodes = append(g.Nodes, GraphNode{ID: id, State: GraphUnresolved})
+	}
+	return g
+}
+
+// WriteJSON writes the Graph as indented JSON
+func (state *LoadedPlugins) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state.Graph())
+}
+
+// WriteDOT writes the Graph in the Graphviz DOT language, e.g. to render with 'dot -Tsvg'.
+// Nodes are filled by state, unresolved ones are outlined in red. Edges point from a plugin
+// to its dependency and are labelled with the range that matched.
+func (state *LoadedPlugins) WriteDOT(w io.Writer) error {
+	g := state.Graph()
+
+	if _, err := fmt.Fprintln(w, "digraph plugins {\n  node [shape=box, style=filled];"); err != nil {
+		return err
+	}
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%s\n%s", nodeLabel(n), n.State)
+		attrs := fmt.Sprintf("label=%q, fillcolor=%q", label, dotColors[n.State])
+		if n.State == GraphUnresolved {
+			attrs += `, color="red", penwidth=2`
+		}
+		if n.Plugin == "" {
+			attrs += `, style="filled,dashed"`
+		}
+		if _, err := fmt.Fprintf(w, "  %q [%s];\n", n.ID, attrs); err != nil {
+			return err
+		}
+	}
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=%q", dependencyString(e.Dependency))
+		if e.Missing {
+			attrs += `, color="red", style="dashed"`
+		} else if e.Dependency.Optional {
+			attrs += `, style="dashed"`
+		}
+		if _, err := fmt.Fprintf(w, "  %q -> %q [%s];\n", e.From, e.To, attrs); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+func nodeLabel(n GraphNode) string {
+	if n.Plugin == "" {
+		return n.ID
+	}
+	return fmt.Sprintf("%s %s", n.Plugin, *n.Version)
+}
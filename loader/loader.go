@@ -8,8 +8,8 @@ package loader
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"time"
 
 	"github.com/rovarghe/mule/plugin"
 )
@@ -30,9 +30,17 @@ type (
 	// It passes through 3 phases: DependenciesRegistered, PluginRegistered and DependentsRegistered
 	RegistrationState int
 
-	// NoRootsLoadError is returned if there are no plugins to be loaded, or if dependencies are circular
+	// NoRootsLoadError is returned if none of the plugins to be loaded is free of dependencies
 	NoRootsLoadError struct{}
 
+	// CycleLoadError is returned if dependencies are circular. Cycle is the chain of plugins
+	// that depend on each other, starting and ending with the same plugin. Unregistered lists
+	// every plugin that could not be registered because of it, including those in Cycle.
+	CycleLoadError struct {
+		Cycle        []plugin.Plugin
+		Unregistered []plugin.Plugin
+	}
+
 	// UnresolvedDependency is returned within UnresolvedDependenciesLoadError for each dependency that could
 	// not be satisfied
 	UnresolvedDependency struct {
@@ -47,6 +55,19 @@ type (
 		all        *map[plugin.ID]pluginList
 	}
 
+	// Conflict is returned within ConflictLoadError for each pair of plugins that cannot be loaded together
+	Conflict struct {
+		Plugin   plugin.Plugin
+		Conflict plugin.Dependency
+		With     plugin.Plugin
+	}
+
+	// ConflictLoadError is returned as the error type if plugins that would be loaded conflict
+	// with each other, see plugin.Conflicter
+	ConflictLoadError struct {
+		Conflicts []Conflict
+	}
+
 	pluginList []*LoadedPlugin
 
 	unresolvedType map[*LoadedPlugin]interface{}
@@ -56,7 +77,12 @@ type (
 		unresolved unresolvedType
 		loaded     pluginList
 		roots      pluginList
-		all        map[plugin.ID]pluginList
+		shadowed   pluginList
+		replaced   pluginList
+		// failed is the plugin whose RegisterFunc failed, if any
+		failed  *LoadedPlugin
+		options loadOptions
+		all     map[plugin.ID]pluginList
 	}
 
 	// LoadedPlugin stores information about a particular plugin as determined by
@@ -67,6 +93,38 @@ type (
 		dependents   pluginList
 		state        RegistrationState
 	}
+
+	// Option changes the default behaviour of Load
+	Option func(*loadOptions)
+
+	loadOptions struct {
+		unregisterFunc UnregisterFunc
+		versionPolicy  VersionPolicy
+		preferred      map[plugin.ID]plugin.ID
+		parallel       bool
+		maxParallel    int
+		startTimeout   time.Duration
+		stopTimeout    time.Duration
+		observers      observers
+	}
+
+	// VersionPolicy decides what Load does when it is given several versions of the same plugin
+	VersionPolicy int
+
+	// PluginError is an error returned by a RegisterFunc or UnregisterFunc for a plugin
+	PluginError struct {
+		Plugin plugin.Plugin
+		Err    error
+	}
+
+	// RollbackLoadError is returned by Load if a RegisterFunc failed and the plugins loaded
+	// before it were unregistered again. Err is the original failure, UnregisterErrors are
+	// the errors returned while rolling back, if any.
+	RollbackLoadError struct {
+		Plugin           plugin.Plugin
+		Err              error
+		UnregisterErrors []PluginError
+	}
 )
 
 const (
@@ -78,36 +136,31 @@ const (
 	// DependentsRegistered indicates all the children of the plugin, i.e. all its dependents have been
 	// successfully registered
 	DependentsRegistered
+	// PluginShadowed indicates the plugin will not be registered because another version of it was
+	// picked instead
+	PluginShadowed
+	// PluginReplaced indicates the plugin will not be registered because another plugin
+	// replaces it, see plugin.Replacer
+	PluginReplaced
 )
 
+const (
+	// SingleVersion registers exactly one version of each plugin ID, the highest version that
+	// satisfies all the dependencies. The other versions are shadowed. This is the default.
+	SingleVersion VersionPolicy = iota
+	// SideBySide registers every version given. Each dependency is linked to the highest version
+	// that satisfies it. Every version must have its dependencies satisfied.
+	SideBySide
+)
+
+// isResolved is true if every mandatory dependency is linked
 func (n *LoadedPlugin) isResolved() bool {
-	return len(n.plugin.Dependencies()) == len(n.dependencies)
-}
-
-func resolve(node *LoadedPlugin, all *map[plugin.ID]pluginList) bool {
-
-	var unresolved = 0
-	for _, d := range node.plugin.Dependencies() {
-		flag := false
-		versions := (*all)[d.ID]
-		if versions != nil {
-			// does any version satisfy dependency
-			for _, v := range versions {
-				if plugin.Satisfies(v.plugin, d) {
-					// Link parent and child
-					node.dependencies[d] = v
-					v.dependents = append(v.dependents, node)
-					flag = true
-					break
-				}
-			}
-		}
-		if !flag {
-			unresolved++
+	for _, d := range n.plugin.Dependencies() {
+		if _, ok := n.dependencies[d]; !ok && !d.Optional {
+			return false
 		}
 	}
-
-	return unresolved == 0
+	return true
 }
 
 func flattenRoots(state *LoadedPlugins, ctx context.Context, RegisterFunc RegisterFunc) error {
@@ -138,17 +191,24 @@ func flattenPluginNodes(n *LoadedPlugin,
 		ii++
 	}
 
+	// Do not start anything once Load is cancelled
+	if err := ctx.Err(); err != nil {
+		state.cancel(n, err)
+		return err
+	}
+
 	state.loaded = append(state.loaded, n)
-	n.state = DependenciesRegistered
+	state.setState(n, DependenciesRegistered)
 
 	(*seen)[n] = true
 
 	// Call the initializer
-	ctx, err := RegisterFunc(ctx, n)
+	ctx, err := state.register(ctx, RegisterFunc, n)
 	if err != nil {
+		state.failed = n
 		return err
 	}
-	n.state = PluginRegistered
+	state.setState(n, PluginRegistered)
 
 	for _, d := range n.dependents {
 		if !(*seen)[d] {
@@ -158,7 +218,7 @@ func flattenPluginNodes(n *LoadedPlugin,
 			}
 		}
 	}
-	n.state = DependentsRegistered
+	state.setState(n, DependentsRegistered)
 
 	return nil
 }
@@ -174,10 +234,133 @@ func (ur *unresolvedType) String() string {
 	return str
 }
 
+func (e PluginError) Error() string {
+	return fmt.Sprintf("Plugin [ %s %s ]: %s", e.Plugin.ID(), e.Plugin.Version(), e.Err)
+}
+
+// Error returns the original failure followed by errors during rollback
+func (e RollbackLoadError) Error() string {
+	str := fmt.Sprintf("Load of plugin [ %s %s ] failed, rolled back: %s", e.Plugin.ID(), e.Plugin.Version(), e.Err)
+	for _, ue := range e.UnregisterErrors {
+		str = fmt.Sprintf("%s\n Rollback error: %s", str, ue.Error())
+	}
+	return str
+}
+
+// Unwrap returns the original failure
+func (e RollbackLoadError) Unwrap() error {
+	return e.Err
+}
+
 func (e NoRootsLoadError) Error() string {
 	return "No roots detected"
 }
 
+// Error returns the cycle as a chain, e.g. a@1.0.0 -> b@2.1.0 -> a@1.0.0
+func (e CycleLoadError) Error() string {
+	str := "Circular dependency: "
+	for i, p := range e.Cycle {
+		if i > 0 {
+			str += " -> "
+		}
+		str += fmt.Sprintf("%s@%s", p.ID(), p.Version())
+	}
+	if extra := len(e.Unregistered) - len(e.Cycle) + 1; extra > 0 {
+		str = fmt.Sprintf("%s (%d other plugin(s) depend on the cycle)", str, extra)
+	}
+	return str
+}
+
+// findCycle returns the plugins that can never be registered because they are part of,
+// or depend on, a dependency cycle. If there are any, one of the cycles is returned as well.
+func findCycle(nodes pluginList) (cycle pluginList, blocked pluginList) {
+	var registrable = map[*LoadedPlugin]bool{}
+
+	for progress := true; progress; {
+		progress = false
+		for _, n := range nodes {
+			if registrable[n] {
+				continue
+			}
+			ready := true
+			for _, dn := range n.dependencies {
+				if !registrable[dn] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				registrable[n] = true
+				progress = true
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		if !registrable[n] {
+			blocked = append(blocked, n)
+		}
+	}
+	if len(blocked) == 0 {
+		return nil, nil
+	}
+
+	// Every blocked plugin has a blocked dependency, so following them must come
+	// back to a plugin already seen. Dependencies are followed in declaration order
+	// so that the same cycle is always reported.
+	var position = map[*LoadedPlugin]int{}
+	for n := blocked[0]; ; {
+		if i, seen := position[n]; seen {
+			return append(cycle[i:], n), blocked
+		}
+		position[n] = len(cycle)
+		cycle = append(cycle, n)
+		for _, d := range n.plugin.Dependencies() {
+			if dn, ok := n.dependencies[d]; ok && !registrable[dn] {
+				n = dn
+				break
+			}
+		}
+	}
+}
+
+// findConflicts returns every plugin in the list that conflicts with another one in the list
+func findConflicts(nodes pluginList) []Conflict {
+	var conflicts []Conflict
+	for _, n := range nodes {
+		for _, c := range plugin.ConflictsOf(n.plugin) {
+			for _, o := range nodes {
+				if o != n && plugin.Satisfies(o.plugin, c) {
+					conflicts = append(conflicts, Conflict{Plugin: n.plugin, Conflict: c, With: o.plugin})
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("Plugin [ %s %s ] conflicts with %s, found %s %s",
+		c.Plugin.ID(), c.Plugin.Version(), c.Conflict.String(), c.With.ID(), c.With.Version())
+}
+
+// Error lists every conflict
+func (e ConflictLoadError) Error() string {
+	str := ""
+	for _, c := range e.Conflicts {
+		str = fmt.Sprintf("%s%s\n", str, c.String())
+	}
+	return str
+}
+
+func (list pluginList) plugins() []plugin.Plugin {
+	var plugins = make([]plugin.Plugin, len(list))
+	for i, n := range list {
+		plugins[i] = n.plugin
+	}
+	return plugins
+}
+
 // Error returns a formatted string error message
 func (e UnresolvedDependenciesLoadError) Error() string {
 	str := ""
@@ -196,6 +379,22 @@ func (e UnresolvedDependenciesLoadError) Error() string {
 	return str
 }
 
+// capabilityProviders lists every plugin providing any version of the capability
+func (e *UnresolvedDependenciesLoadError) capabilityProviders(name plugin.ID) []plugin.Plugin {
+	var providers = []plugin.Plugin{}
+	for _, versions := range *e.all {
+		for _, n := range versions {
+			for _, c := range plugin.ProvidesOf(n.plugin) {
+				if c.Name == name {
+					providers = append(providers, n.plugin)
+					break
+				}
+			}
+		}
+	}
+	return providers
+}
+
 // UnresolvedDependencies lists all the dependencies that could not be resolved
 func (e *UnresolvedDependenciesLoadError) UnresolvedDependencies() []UnresolvedDependency {
 	var list = []UnresolvedDependency{}
@@ -205,10 +404,17 @@ func (e *UnresolvedDependenciesLoadError) UnresolvedDependencies() []UnresolvedD
 			Dependency: map[plugin.Dependency][]plugin.Plugin{},
 		}
 		for _, d := range u.plugin.Dependencies() {
+			if d.Optional {
+				continue
+			}
 
 			var candidates = []plugin.Plugin{}
-			for _, c := range (*e.all)[d.ID] {
-				candidates = append(candidates, c.plugin)
+			if d.Capability {
+				candidates = e.capabilityProviders(d.ID)
+			} else {
+				for _, c := range (*e.all)[d.ID] {
+					candidates = append(candidates, c.plugin)
+				}
 			}
 
 			ud.Dependency[d] = candidates
@@ -220,9 +426,95 @@ func (e *UnresolvedDependenciesLoadError) UnresolvedDependencies() []UnresolvedD
 	return list
 }
 
+// WithRollback makes Load unregister, in reverse order, every plugin it loaded
+// if a RegisterFunc fails. Load then either succeeds or leaves nothing loaded.
+func WithRollback(unregisterFunc UnregisterFunc) Option {
+	return func(o *loadOptions) {
+		o.unregisterFunc = unregisterFunc
+	}
+}
+
+// WithVersionPolicy chooses how Load treats several versions of the same plugin
+func WithVersionPolicy(policy VersionPolicy) Option {
+	return func(o *loadOptions) {
+		o.versionPolicy = policy
+	}
+}
+
+// WithProvider prefers the plugin with ID provider for dependencies on a capability, whenever
+// it provides a version the dependency allows. Without it the provider of the highest version
+// of the capability is picked, ties broken by the lowest plugin ID.
+func WithProvider(capability plugin.ID, provider plugin.ID) Option {
+	return func(o *loadOptions) {
+		if o.preferred == nil {
+			o.preferred = map[plugin.ID]plugin.ID{}
+		}
+		o.preferred[capability] = provider
+	}
+}
+
+// WithParallelism makes Load register plugins concurrently, each one as soon as all of its
+// dependencies are PluginRegistered, with at most max RegisterFuncs running at once, or
+// without limit if max is 0 or less. RegisterFunc must then be safe for concurrent use.
+//
+// A plugin gets the context returned by the RegisterFunc of the last of its dependencies to
+// complete. Plugins are still unregistered in the reverse order they were registered in.
+// If a RegisterFunc fails, no more plugins are registered, the ones already running are
+// waited for, and the first error is returned, like it would be without parallelism.
+func WithParallelism(max int) Option {
+	return func(o *loadOptions) {
+		o.parallel = true
+		o.maxParallel = max
+	}
+}
+
 // Load goes through each plugin in order of its depedencies and pass
 // it to the RegisterFunc to do whatever initialization it wants to do.
-func Load(ctx context.Context, plugins []plugin.Plugin, RegisterFunc RegisterFunc) (context.Context, *LoadedPlugins, error) {
+func Load(ctx context.Context, plugins []plugin.Plugin, RegisterFunc RegisterFunc, opts ...Option) (context.Context, *LoadedPlugins, error) {
+	var options loadOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	options.observers.notify(func(o Observer) { o.Resolving(plugins) })
+	state, nodes, problems := resolve(plugins, options)
+	state.options = options
+	var problem error
+	if len(problems) != 0 {
+		problem = problems[0]
+	}
+	options.observers.notify(func(o Observer) { o.Resolved(state, problem) })
+	if problem != nil {
+		return ctx, state, problem
+	}
+	if len(nodes) == 0 {
+		return ctx, state, nil
+	}
+
+	var err error
+	if options.parallel {
+		err = registerParallel(state, ctx, RegisterFunc, nodes, options.maxParallel)
+	} else {
+		err = flattenRoots(state, ctx, RegisterFunc)
+	}
+	if err == nil && len(state.loaded) != len(nodes) {
+		// Should not happen once cycles are ruled out, but never silently skip a plugin
+		err = fmt.Errorf("Only %d of %d plugins were registered", len(state.loaded), len(nodes))
+	}
+	if err != nil && options.unregisterFunc != nil {
+		err = state.rollback(ctx, err, options.unregisterFunc)
+	}
+	return ctx, state, err
+
+}
+
+// resolve picks and links the plugins to register without registering any of them.
+// It goes on past problems for as long as it can, so that all of them are reported, in
+// the order Load checks for them. The plugins returned are those that could be registered
+// despite the problems.
+func resolve(plugins []plugin.Plugin, options loadOptions) (*LoadedPlugins, pluginList, []error) {
+	var problems []error
+
 	state := &LoadedPlugins{
 		unresolved: unresolvedType{},
 		loaded:     pluginList{},
@@ -231,59 +523,127 @@ func Load(ctx context.Context, plugins []plugin.Plugin, RegisterFunc RegisterFun
 	}
 
 	if len(plugins) == 0 {
-		return ctx, state, nil
+		return state, pluginList{}, nil
 	}
 
+	var nodes = pluginList{}
 	for _, p := range plugins {
 		node := &LoadedPlugin{
 			plugin:       p,
 			dependencies: map[plugin.Dependency]*LoadedPlugin{},
 			dependents:   pluginList{},
 		}
-		if !resolve(node, &state.all) {
-			state.unresolved[node] = true
-		}
-
-		if len(p.Dependencies()) == 0 {
-			state.roots = append(state.roots, node)
-		}
-
+		nodes = append(nodes, node)
 		state.all[p.ID()] = append(state.all[p.ID()], node)
+	}
 
+	// Replaced versions are never candidates, dependencies on them are linked to the replacement
+	state.replaced = findReplaced(nodes)
+	var available = map[plugin.ID]pluginList{}
+	for _, n := range nodes.without(state.replaced) {
+		available[n.plugin.ID()] = append(available[n.plugin.ID()], n)
+	}
+	for _, n := range state.replaced {
+		n.state = PluginReplaced
 	}
+	nodes = nodes.without(state.replaced)
 
-	for nomas := true; nomas && len(state.unresolved) > 0; {
-		nomas = false
-		for n := range state.unresolved {
-			if resolve(n, &state.all) {
-				delete(state.unresolved, n)
-				nomas = true
-			}
+	r, discarded := newResolver(available, options.preferred)
+	for _, n := range discarded {
+		// With a single version, only an error if no other version of the plugin can be used instead
+		if options.versionPolicy == SideBySide || len(r.candidates[n.plugin.ID()]) == 0 {
+			state.unresolved[n] = true
 		}
 	}
 
 	if len(state.unresolved) != 0 {
-		return ctx, state, UnresolvedDependenciesLoadError{
+		problems = append(problems, UnresolvedDependenciesLoadError{
 			unresolved: &state.unresolved,
 			all:        &state.all,
+		})
+	}
+
+	if options.versionPolicy == SideBySide {
+		nodes = r.linkHighest(nodes)
+	} else {
+		selected := r.solve(r.ids)
+		if selected == nil {
+			// Nothing can be linked
+			return state, pluginList{}, append(problems, r.conflict())
+		}
+		var linked = r.link(selected, nodes)
+		state.shadowed = pluginList{}
+		for _, n := range nodes.without(linked) {
+			if state.unresolved[n] == nil {
+				n.state = PluginShadowed
+				state.shadowed = append(state.shadowed, n)
+			}
 		}
+		nodes = linked
 	}
 
-	if len(state.roots) == 0 {
-		return ctx, state, errors.New("No roots")
+	if conflicts := findConflicts(nodes); len(conflicts) != 0 {
+		problems = append(problems, ConflictLoadError{Conflicts: conflicts})
 	}
 
-	err := flattenRoots(state, ctx, RegisterFunc)
-	return ctx, state, err
+	for _, n := range nodes {
+		if len(n.dependencies) == 0 {
+			state.roots = append(state.roots, n)
+		}
+	}
+
+	if cycle, blocked := findCycle(nodes); cycle != nil {
+		problems = append(problems, CycleLoadError{
+			Cycle:        cycle.plugins(),
+			Unregistered: blocked.plugins(),
+		})
+		nodes = nodes.without(blocked)
+	}
 
+	if len(state.roots) == 0 && len(nodes) != 0 {
+		problems = append(problems, NoRootsLoadError{})
+	}
+
+	return state, nodes, problems
 }
 
-// Unload deregisters the plugins that were successfuly registered by Load()
+// rollback unregisters all the loaded plugins in reverse order, including the one that failed.
+// Unlike Unload it does not stop at the first error.
+// Plugins are unregistered even if ctx was cancelled.
+func (state *LoadedPlugins) rollback(ctx context.Context, cause error, unRegisterFunc UnregisterFunc) error {
+	if len(state.loaded) == 0 {
+		return cause
+	}
+	ctx = context.WithoutCancel(ctx)
+	rollbackErr := RollbackLoadError{
+		Plugin: state.loaded[len(state.loaded)-1].plugin,
+		Err:    cause,
+	}
+	if state.failed != nil {
+		rollbackErr.Plugin = state.failed.plugin
+	}
+
+	for i := len(state.loaded); i > 0; i-- {
+		lp := state.loaded[i-1]
+		unregisteredCtx, err := state.unregister(ctx, unRegisterFunc, lp)
+		if err != nil {
+			rollbackErr.UnregisterErrors = append(rollbackErr.UnregisterErrors, PluginError{Plugin: lp.plugin, Err: err})
+		} else if unregisteredCtx != nil {
+			ctx = unregisteredCtx
+		}
+	}
+	state.loaded = pluginList{}
+
+	return rollbackErr
+}
+
+// Unload deregisters the plugins that were successfuly registered by Load(), each within the
+// stop timeout given to Load
 func (state *LoadedPlugins) Unload(ctx context.Context, unRegisterFunc UnregisterFunc) (context.Context, error) {
 	var i = len(state.loaded)
 	var err error
 	for ; i > 0; i-- {
-		ctx, err = unRegisterFunc(ctx, state.loaded[i-1])
+		ctx, err = state.unregister(ctx, unRegisterFunc, state.loaded[i-1])
 		if err != nil {
 			break
 		}
@@ -292,6 +652,30 @@ func (state *LoadedPlugins) Unload(ctx context.Context, unRegisterFunc Unregiste
 	return ctx, err
 }
 
+// UnloadWhere deregisters the registered plugins for which match returns true, dependents
+// first, each within the stop timeout given to Load. The others stay registered, so that some
+// plugins can be restarted while the rest keep running. Every matching plugin is deregistered
+// even if some fail, the errors are returned in the order they happened.
+func (state *LoadedPlugins) UnloadWhere(ctx context.Context, match func(*LoadedPlugin) bool, unRegisterFunc UnregisterFunc) (context.Context, []PluginError) {
+	var errs []PluginError
+	var kept = pluginList{}
+	for i := len(state.loaded); i > 0; i-- {
+		lp := state.loaded[i-1]
+		if !match(lp) {
+			kept = append(pluginList{lp}, kept...)
+			continue
+		}
+		unregisteredCtx, err := state.unregister(ctx, unRegisterFunc, lp)
+		if err != nil {
+			errs = append(errs, PluginError{Plugin: lp.plugin, Err: err})
+		} else if unregisteredCtx != nil {
+			ctx = unregisteredCtx
+		}
+	}
+	state.loaded = kept
+	return ctx, errs
+}
+
 func (state *LoadedPlugins) Count() int {
 	return len(state.loaded)
 }
@@ -300,6 +684,17 @@ func (state *LoadedPlugins) Get(i int) *LoadedPlugin {
 	return state.loaded[i]
 }
 
+// Shadowed lists the plugins that were not registered because another version
+// of the same plugin was picked. Only the SingleVersion policy shadows plugins.
+func (state *LoadedPlugins) Shadowed() []*LoadedPlugin {
+	return append([]*LoadedPlugin{}, state.shadowed...)
+}
+
+// Replaced lists the plugins that were not registered because another plugin replaces them
+func (state *LoadedPlugins) Replaced() []*LoadedPlugin {
+	return append([]*LoadedPlugin{}, state.replaced...)
+}
+
 func (n *LoadedPlugin) Plugin() plugin.Plugin {
 	return n.plugin
 }
@@ -2,7 +2,14 @@ package loader_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rovarghe/mule/loader"
 	"github.com/rovarghe/mule/plugin"
@@ -22,9 +29,9 @@ func registerFunc(t *testing.T) loader.RegisterFunc {
 
 func unregisterFunc(t *testing.T) loader.UnregisterFunc {
 	return func(ctx context.Context, ps *loader.LoadedPlugin) (context.Context, error) {
-		t.Log("Unloading plugin", ps.Plugin().ID)
+		t.Log("Unloading plugin", ps.Plugin().ID())
 		if ps.State() != loader.PluginRegistered && ps.State() != loader.DependentsRegistered {
-			t.Error("Unexpected state, expecting PluginLoadedState", ps.State(), ps.Plugin().ID, ps.Plugin().Version)
+			t.Error("Unexpected state, expecting PluginLoadedState", ps.State(), ps.Plugin().ID(), ps.Plugin().Version())
 		}
 		return ctx, nil
 	}
@@ -128,8 +135,1036 @@ func TestLoadPlugins2(t *testing.T) {
 
 		orders[p.ID()] = true
 		if !checked {
-			t.Error("Failed check", i, p.ID)
+			t.Error("Failed check", i, p.ID())
 		}
 	}
 
 }
+
+func TestLoadRollback(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.MavenTestPlugin,
+		harness.MavenPlugin,
+		harness.BasePlugin,
+	}
+
+	startErr := errors.New("maven-test failed")
+	stopErr := errors.New("maven failed to stop")
+	var unregistered []plugin.ID
+
+	register := func(ctx context.Context, ps *loader.LoadedPlugin) (context.Context, error) {
+		if ps.Plugin().ID() == harness.MavenTestPlugin.ID() {
+			return ctx, startErr
+		}
+		return ctx, nil
+	}
+	unregister := func(ctx context.Context, ps *loader.LoadedPlugin) (context.Context, error) {
+		unregistered = append(unregistered, ps.Plugin().ID())
+		if ps.Plugin().ID() == harness.MavenPlugin.ID() {
+			return ctx, stopErr
+		}
+		return ctx, nil
+	}
+
+	_, loaded, err := loader.Load(context.Background(), plugins, register, loader.WithRollback(unregister))
+
+	rollbackErr, ok := err.(loader.RollbackLoadError)
+	if !ok {
+		t.Fatal("Expecting RollbackLoadError, got", err)
+	}
+	if rollbackErr.Err != startErr || rollbackErr.Plugin.ID() != harness.MavenTestPlugin.ID() {
+		t.Error("Unexpected cause", rollbackErr.Plugin.ID(), rollbackErr.Err)
+	}
+	if len(rollbackErr.UnregisterErrors) != 1 || rollbackErr.UnregisterErrors[0].Err != stopErr {
+		t.Error("Expecting rollback error for maven", rollbackErr.UnregisterErrors)
+	}
+	if !reflect.DeepEqual(unregistered, []plugin.ID{"maven-test", "maven", "base"}) {
+		t.Error("Unexpected rollback order", unregistered)
+	}
+	if loaded.Count() != 0 {
+		t.Error("Expecting nothing loaded after rollback, got", loaded.Count())
+	}
+}
+
+func dependsOn(id plugin.ID, version plugin.Version, deps ...plugin.ID) plugin.Plugin {
+	var dependencies = []plugin.Dependency{}
+	for _, d := range deps {
+		dependencies = append(dependencies, plugin.Dependency{
+			ID: d,
+			Range: plugin.Range{
+				Minimum:      harness.V1_0_0,
+				Maximum:      harness.V2_0_0rel,
+				MinInclusive: true,
+				MaxInclusive: true,
+			},
+		})
+	}
+	return plugin.NewPlugin(id, version, dependencies)
+}
+
+func TestLoadCycle(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		dependsOn("c", harness.V1_0_0, "a"),
+		dependsOn("a", harness.V1_0_0, "base", "b"),
+		dependsOn("b", harness.V2_0_0rel, "a"),
+	}
+
+	registered := 0
+	register := func(ctx context.Context, ps *loader.LoadedPlugin) (context.Context, error) {
+		registered++
+		return ctx, nil
+	}
+
+	_, _, err := loader.Load(context.Background(), plugins, register)
+
+	cycleErr, ok := err.(loader.CycleLoadError)
+	if !ok {
+		t.Fatal("Expecting CycleLoadError, got", err)
+	}
+	if registered != 0 {
+		t.Error("Nothing should be registered when there is a cycle, got", registered)
+	}
+	if len(cycleErr.Unregistered) != 3 {
+		t.Error("Expecting a, b and c to be unregistered, got", cycleErr.Unregistered)
+	}
+	expected := "Circular dependency: a@1.0.0 -> b@2.0.0-rel -> a@1.0.0 (1 other plugin(s) depend on the cycle)"
+	if cycleErr.Error() != expected {
+		t.Error("Unexpected message", cycleErr.Error())
+	}
+}
+
+func TestLoadOnlyCycle(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		dependsOn("a", harness.V1_0_0, "a"),
+	}
+
+	_, _, err := loader.Load(context.Background(), plugins, registerFunc(t))
+
+	if cycleErr, ok := err.(loader.CycleLoadError); !ok || cycleErr.Error() != "Circular dependency: a@1.0.0 -> a@1.0.0" {
+		t.Error("Expecting self dependency to be a cycle, got", err)
+	}
+}
+
+func requires(t *testing.T, id plugin.ID, version string, deps ...string) plugin.Plugin {
+	v, err := plugin.ParseVersion(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dependencies = []plugin.Dependency{}
+	for _, s := range deps {
+		d, err := plugin.ParseDependency(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dependencies = append(dependencies, *d)
+	}
+	return plugin.NewPlugin(id, *v, dependencies)
+}
+
+func loadedVersions(loaded *loader.LoadedPlugins) map[plugin.ID]string {
+	var versions = map[plugin.ID]string{}
+	for i := 0; i < loaded.Count(); i++ {
+		p := loaded.Get(i).Plugin()
+		versions[p.ID()] = p.Version().String()
+	}
+	return versions
+}
+
+func TestLoadPicksHighestConsistentVersion(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "maven", "1.0.1", "base [1.0.0,1.0.2)"),
+		requires(t, "maven", "1.5.0", "base [1.0.0,1.0.2)"),
+		requires(t, "maven", "1.0.2", "base [1.0.0,1.0.2)"),
+		requires(t, "maven-test", "1.0.1", "maven (1.0.0,2.0.0-beta)"),
+		requires(t, "maven-artifact", "1.0.0", "maven (1.0.0,1.0.2]"),
+	}
+
+	// Same result whatever the input order
+	for i := 0; i < len(plugins); i++ {
+		rotated := append(append([]plugin.Plugin{}, plugins[i:]...), plugins[:i]...)
+		_, loaded, err := loader.Load(context.Background(), rotated, registerFunc(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions := loadedVersions(loaded)
+		if versions["maven"] != "1.0.2" || loaded.Count() != 4 {
+			t.Error("Expecting maven 1.0.2 and one version of each plugin, got", versions, "for order", i)
+		}
+	}
+
+	// Without maven-artifact the newest maven is picked
+	_, loaded, err := loader.Load(context.Background(), plugins[:5], registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := loadedVersions(loaded)["maven"]; v != "1.5.0" {
+		t.Error("Expecting maven 1.5.0, got", v)
+	}
+}
+
+func TestLoadVersionConflict(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		harness.GitPlugin,
+		requires(t, "maven", "1.0.2", "base [1.0.0,1.0.2)"),
+		requires(t, "maven", "1.5.0", "base [1.0.0,1.0.2)"),
+		requires(t, "new", "1.0.0", "maven [1.5.0,2.0.0)"),
+		requires(t, "old", "1.0.0", "maven [1.0.0,1.0.2]"),
+	}
+
+	_, _, err := loader.Load(context.Background(), plugins, registerFunc(t))
+
+	conflict, ok := err.(loader.VersionConflictLoadError)
+	if !ok {
+		t.Fatal("Expecting VersionConflictLoadError, got", err)
+	}
+	if !reflect.DeepEqual(conflict.IDs, []plugin.ID{"maven", "new", "old"}) {
+		t.Error("Expecting minimal conflict between maven, new and old, got", conflict.IDs)
+	}
+	if len(conflict.Requirements) != 2 || len(conflict.Candidates["maven"]) != 2 {
+		t.Error("Unexpected explanation", conflict.Error())
+	}
+}
+
+func TestLoadShadowsOtherVersions(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "maven", "1.0.2", "base [1.0.0,1.0.2)"),
+		requires(t, "maven", "1.5.0", "base [1.0.0,1.0.2)"),
+		requires(t, "maven", "1.6.0", "base [3.0.0,4.0.0)"),
+	}
+
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := loadedVersions(loaded)["maven"]; v != "1.5.0" || loaded.Count() != 2 {
+		t.Error("Expecting only maven 1.5.0 besides base, got", loadedVersions(loaded))
+	}
+	shadowed := loaded.Shadowed()
+	if len(shadowed) != 2 {
+		t.Fatal("Expecting two shadowed versions, got", len(shadowed))
+	}
+	for _, lp := range shadowed {
+		if lp.State() != loader.PluginShadowed || lp.Plugin().ID() != "maven" {
+			t.Error("Unexpected shadowed plugin", lp.Plugin().ID(), lp.Plugin().Version(), lp.State())
+		}
+	}
+}
+
+func TestLoadSideBySide(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "maven", "1.0.2", "base [1.0.0,1.0.2)"),
+		requires(t, "maven", "1.5.0", "base [1.0.0,1.0.2)"),
+		requires(t, "old", "1.0.0", "maven [1.0.0,1.0.2]"),
+		requires(t, "new", "1.0.0", "maven [1.0.0,2.0.0)"),
+	}
+
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t), loader.WithVersionPolicy(loader.SideBySide))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 5 || len(loaded.Shadowed()) != 0 {
+		t.Fatal("Expecting every version to be loaded, got", loaded.Count())
+	}
+
+	for i := 0; i < loaded.Count(); i++ {
+		lp := loaded.Get(i)
+		for d, dn := range lp.Dependencies() {
+			if d.ID != "maven" {
+				continue
+			}
+			expected := map[plugin.ID]string{"old": "1.0.2", "new": "1.5.0"}[lp.Plugin().ID()]
+			if dn.Plugin().Version().String() != expected {
+				t.Error(lp.Plugin().ID(), "should be linked to maven", expected, "got", dn.Plugin().Version())
+			}
+		}
+	}
+
+	// A version that cannot be resolved is an error when every version must load
+	plugins = append(plugins, requires(t, "maven", "1.6.0", "base [3.0.0,4.0.0)"))
+	_, _, err = loader.Load(context.Background(), plugins, registerFunc(t), loader.WithVersionPolicy(loader.SideBySide))
+	if _, ok := err.(loader.UnresolvedDependenciesLoadError); !ok {
+		t.Error("Expecting UnresolvedDependenciesLoadError, got", err)
+	}
+}
+
+func TestLoadVersionConflictExplained(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "maven", "1.5.0", "base [1.0.0,1.0.2)"),
+		requires(t, "maven", "1.0.3", "base [1.0.0,1.0.2)"),
+		requires(t, "maven-test", "1.0.1", "maven [1.0.0,1.0.4)"),
+		requires(t, "maven-artifact", "1.0.0", "maven [1.0.0,1.0.2] || [1.0.4,1.5.0]"),
+	}
+
+	_, _, err := loader.Load(context.Background(), plugins, registerFunc(t))
+	if _, ok := err.(loader.VersionConflictLoadError); !ok {
+		t.Fatal("Expecting VersionConflictLoadError, got", err)
+	}
+
+	expected := " maven-artifact needs maven [1.0.0,1.0.2] || [1.0.4,1.5.0] but maven-test needs [1.0.0,1.0.4); " +
+		"their intersection is [1.0.0,1.0.2], which no candidate is within\n"
+	if !strings.Contains(err.Error(), expected) {
+		t.Error("Expecting explanation", expected, "got", err.Error())
+	}
+}
+
+func TestLoadOptionalDependency(t *testing.T) {
+	order := func(loaded *loader.LoadedPlugins) []plugin.ID {
+		var ids []plugin.ID
+		for i := 0; i < loaded.Count(); i++ {
+			ids = append(ids, loaded.Get(i).Plugin().ID())
+		}
+		return ids
+	}
+
+	web := requires(t, "web", "1.0.0", "base [1.0.0,2.0.0)", "metrics ^1 optional")
+
+	// Absent, web loads without it
+	_, loaded, err := loader.Load(context.Background(), []plugin.Plugin{web, harness.BasePlugin}, registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(order(loaded)) != "[base web]" {
+		t.Error("Unexpected load order", order(loaded))
+	}
+	if len(loaded.Get(1).Dependencies()) != 1 {
+		t.Error("Expected only base to be linked", loaded.Get(1).Dependencies())
+	}
+
+	// Present, metrics is linked and loaded before web
+	metrics := requires(t, "metrics", "1.2.0", "base [1.0.0,2.0.0)")
+	_, loaded, err = loader.Load(context.Background(), []plugin.Plugin{web, metrics, harness.BasePlugin}, registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(order(loaded)) != "[base metrics web]" {
+		t.Error("Unexpected load order", order(loaded))
+	}
+	found := false
+	for d, dn := range loaded.Get(2).Dependencies() {
+		if d.ID == "metrics" {
+			found = plugin.PluginEquals(dn.Plugin(), metrics)
+		}
+	}
+	if !found {
+		t.Error("Expected metrics to be linked to web")
+	}
+
+	// Present in a version that does not satisfy it, treated as absent
+	metrics2 := requires(t, "metrics", "2.0.0", "base [1.0.0,2.0.0)")
+	_, loaded, err = loader.Load(context.Background(), []plugin.Plugin{web, metrics2, harness.BasePlugin}, registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 3 {
+		t.Fatal("Expected metrics 2.0.0 to be loaded", order(loaded))
+	}
+	for i := 0; i < loaded.Count(); i++ {
+		if lp := loaded.Get(i); lp.Plugin().ID() == "web" && len(lp.Dependencies()) != 1 {
+			t.Error("Expected metrics 2.0.0 not to be linked to web", lp.Dependencies())
+		}
+	}
+}
+
+// declares builds a plugin that also declares conflicts and replacements
+func declares(t *testing.T, p plugin.Plugin, conflicts []string, replaces []string) plugin.Plugin {
+	var m = plugin.Manifest{ID: p.ID(), Version: p.Version(), Dependencies: p.Dependencies()}
+	for _, s := range conflicts {
+		d, err := plugin.ParseDependency(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Conflicts = append(m.Conflicts, *d)
+	}
+	for _, s := range replaces {
+		d, err := plugin.ParseDependency(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Replaces = append(m.Replaces, *d)
+	}
+	return m.Plugin()
+}
+
+func TestLoadConflicts(t *testing.T) {
+	ldap := declares(t, requires(t, "auth-ldap", "1.0.0", "base [1.0.0,2.0.0)"), []string{"auth-saml [1.0.0,2.0.0)"}, nil)
+	saml1 := requires(t, "auth-saml", "1.5.0", "base [1.0.0,2.0.0)")
+	saml2 := requires(t, "auth-saml", "2.1.0", "base [1.0.0,2.0.0)")
+
+	_, loaded, err := loader.Load(context.Background(), []plugin.Plugin{harness.BasePlugin, ldap, saml1}, registerFunc(t))
+	conflictErr, ok := err.(loader.ConflictLoadError)
+	if !ok {
+		t.Fatal("Expecting ConflictLoadError, got", err)
+	}
+	if len(conflictErr.Conflicts) != 1 || conflictErr.Conflicts[0].Plugin.ID() != "auth-ldap" ||
+		!plugin.PluginEquals(conflictErr.Conflicts[0].With, saml1) {
+		t.Error("Unexpected conflicts", conflictErr.Conflicts)
+	}
+	if loaded.Count() != 0 {
+		t.Error("Expecting nothing to be loaded")
+	}
+	if !strings.Contains(err.Error(), "conflicts with auth-saml [1.0.0,2.0.0), found auth-saml 1.5.0") {
+		t.Error("Unexpected message", err)
+	}
+
+	// A version outside the conflicting range can be loaded alongside
+	_, loaded, err = loader.Load(context.Background(), []plugin.Plugin{harness.BasePlugin, ldap, saml2}, registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 3 {
+		t.Error("Expecting all plugins to be loaded", loadedVersions(loaded))
+	}
+}
+
+func TestLoadReplaces(t *testing.T) {
+	maven := requires(t, "maven", "1.0.0", "base [1.0.0,2.0.0)")
+	maven2 := declares(t, requires(t, "maven2", "2.0.0", "base [1.0.0,2.0.0)"), nil, []string{"maven [1.0.0,2.0.0)"})
+	mavenTest := requires(t, "maven-test", "1.0.0", "maven [1.0.0,2.0.0)")
+
+	for _, plugins := range [][]plugin.Plugin{
+		{harness.BasePlugin, maven, maven2, mavenTest},
+		{harness.BasePlugin, maven2, mavenTest},
+	} {
+		_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		versions := loadedVersions(loaded)
+		if _, ok := versions["maven"]; ok || len(versions) != 3 {
+			t.Error("Expecting maven to be replaced", versions)
+		}
+		if len(plugins) == 4 && (len(loaded.Replaced()) != 1 || loaded.Replaced()[0].State() != loader.PluginReplaced) {
+			t.Error("Expecting maven in Replaced", loaded.Replaced())
+		}
+
+		for i := 0; i < loaded.Count(); i++ {
+			lp := loaded.Get(i)
+			if lp.Plugin().ID() != "maven-test" {
+				continue
+			}
+			for _, dn := range lp.Dependencies() {
+				if dn.Plugin().ID() != "maven2" {
+					t.Error("Expecting maven-test to be linked to maven2, got", dn.Plugin().ID())
+				}
+			}
+		}
+	}
+
+	// The replacement does not cover maven 2.x
+	mavenTest2 := requires(t, "maven-test", "2.0.0", "maven [2.0.0,3.0.0)")
+	_, _, err := loader.Load(context.Background(), []plugin.Plugin{harness.BasePlugin, maven2, mavenTest2}, registerFunc(t))
+	if _, ok := err.(loader.UnresolvedDependenciesLoadError); !ok {
+		t.Error("Expecting UnresolvedDependenciesLoadError, got", err)
+	}
+}
+
+// providing builds a plugin that also provides capabilities
+func providing(t *testing.T, p plugin.Plugin, capabilities ...string) plugin.Plugin {
+	var m = plugin.Manifest{ID: p.ID(), Version: p.Version(), Dependencies: p.Dependencies()}
+	for _, s := range capabilities {
+		c, err := plugin.ParseCapability(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Provides = append(m.Provides, *c)
+	}
+	return m.Plugin()
+}
+
+func TestLoadCapabilities(t *testing.T) {
+	linkedProvider := func(loaded *loader.LoadedPlugins) plugin.ID {
+		for i := 0; i < loaded.Count(); i++ {
+			if lp := loaded.Get(i); lp.Plugin().ID() == "app" {
+				for d, dn := range lp.Dependencies() {
+					if d.ID == "session-store" {
+						return dn.Plugin().ID()
+					}
+				}
+			}
+		}
+		return ""
+	}
+
+	app := requires(t, "app", "1.0.0", "base [1.0.0,2.0.0)", "session-store ^1 capability")
+	redis := providing(t, requires(t, "session-redis", "3.0.0", "base [1.0.0,2.0.0)"), "session-store 1.0.0")
+	memory := providing(t, requires(t, "session-memory", "1.0.0", "base [1.0.0,2.0.0)"), "session-store 1.0.0")
+	redis12 := providing(t, requires(t, "session-redis", "3.1.0", "base [1.0.0,2.0.0)"), "session-store 1.2.0")
+
+	var table = []struct {
+		plugins  []plugin.Plugin
+		opts     []loader.Option
+		provider plugin.ID
+	}{
+		// Same version of the capability, the lowest plugin ID wins
+		{[]plugin.Plugin{harness.BasePlugin, app, redis, memory}, nil, "session-memory"},
+		// Pinned
+		{[]plugin.Plugin{harness.BasePlugin, app, redis, memory}, []loader.Option{loader.WithProvider("session-store", "session-redis")}, "session-redis"},
+		// Highest version of the capability
+		{[]plugin.Plugin{harness.BasePlugin, app, redis12, memory}, nil, "session-redis"},
+		// Pinned to a plugin that is not present
+		{[]plugin.Plugin{harness.BasePlugin, app, memory}, []loader.Option{loader.WithProvider("session-store", "session-redis")}, "session-memory"},
+		{[]plugin.Plugin{harness.BasePlugin, app, redis12, memory}, []loader.Option{loader.WithVersionPolicy(loader.SideBySide)}, "session-redis"},
+	}
+
+	for i, r := range table {
+		_, loaded, err := loader.Load(context.Background(), r.plugins, registerFunc(t), r.opts...)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if p := linkedProvider(loaded); p != r.provider {
+			t.Error(i, "Expecting", r.provider, "got", p)
+		}
+	}
+
+	_, _, err := loader.Load(context.Background(), []plugin.Plugin{harness.BasePlugin, app}, registerFunc(t))
+	if _, ok := err.(loader.UnresolvedDependenciesLoadError); !ok {
+		t.Error("Expecting UnresolvedDependenciesLoadError, got", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		requires(t, "maven-test", "1.0.0", "maven [1.0.0,2.0.0)"),
+		requires(t, "maven", "1.0.1", "base [1.0.0,2.0.0)"),
+		requires(t, "maven", "1.0.2", "base [1.0.0,2.0.0)"),
+		harness.BasePlugin,
+	}
+
+	plan, err := loader.Plan(plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, p := range plan.Order {
+		order = append(order, fmt.Sprintf("%s@%s", p.ID(), p.Version()))
+	}
+	if fmt.Sprint(order) != "[base@1.0.0 maven@1.0.2 maven-test@1.0.0]" {
+		t.Error("Unexpected order", order)
+	}
+	if len(plan.Links) != 2 || plan.Links[1].String() != "maven-test 1.0.0 -> maven [1.0.0,2.0.0): maven 1.0.2" {
+		t.Error("Unexpected links", plan.Links)
+	}
+	if len(plan.Unused) != 1 || plan.Unused[0].ID() != "maven-test" {
+		t.Error("Unexpected unused", plan.Unused)
+	}
+	if len(plan.Shadowed) != 1 || plan.Shadowed[0].Version().String() != "1.0.1" {
+		t.Error("Unexpected shadowed", plan.Shadowed)
+	}
+
+	// Matches what Load does
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range plan.Order {
+		if !plugin.PluginEquals(loaded.Get(i).Plugin(), p) {
+			t.Error("Load order differs from plan at", i, loaded.Get(i).Plugin())
+		}
+	}
+}
+
+func TestPlanOrderWithConflict(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		requires(t, "web", "1.0.0", "auth-saml [1.0.0,2.0.0)"),
+		declares(t, requires(t, "auth-ldap", "1.0.0", "base [1.0.0,2.0.0)"), []string{"auth-saml *"}, nil),
+		requires(t, "auth-saml", "1.0.0", "base [1.0.0,2.0.0)"),
+		harness.BasePlugin,
+	}
+
+	plan, err := loader.Plan(plugins)
+	planErr, ok := err.(loader.PlanError)
+	if !ok || len(planErr) != 1 {
+		t.Fatal("Expecting 1 problem, got", err)
+	}
+	if _, ok := planErr[0].(loader.ConflictLoadError); !ok {
+		t.Error("Expecting ConflictLoadError, got", planErr[0])
+	}
+
+	// The conflicting plugins and their dependents are still ordered
+	var order []string
+	for _, p := range plan.Order {
+		order = append(order, string(p.ID()))
+	}
+	if fmt.Sprint(order) != "[base auth-ldap auth-saml web]" {
+		t.Error("Unexpected order", order)
+	}
+}
+
+func TestPlanReportsEveryProblem(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "orphan", "1.0.0", "missing [1.0.0,2.0.0)"),
+		declares(t, requires(t, "auth-ldap", "1.0.0", "base [1.0.0,2.0.0)"), []string{"auth-saml *"}, nil),
+		requires(t, "auth-saml", "1.0.0", "base [1.0.0,2.0.0)"),
+		dependsOn("a", harness.V1_0_0, "base", "b"),
+		dependsOn("b", harness.V1_0_0, "a"),
+	}
+
+	plan, err := loader.Plan(plugins)
+	planErr, ok := err.(loader.PlanError)
+	if !ok || len(planErr) != 3 {
+		t.Fatal("Expecting 3 problems, got", err)
+	}
+	if _, ok := planErr[0].(loader.UnresolvedDependenciesLoadError); !ok {
+		t.Error("Expecting UnresolvedDependenciesLoadError first, got", planErr[0])
+	}
+	if _, ok := planErr[1].(loader.ConflictLoadError); !ok {
+		t.Error("Expecting ConflictLoadError, got", planErr[1])
+	}
+	if _, ok := planErr[2].(loader.CycleLoadError); !ok {
+		t.Error("Expecting CycleLoadError, got", planErr[2])
+	}
+	if !reflect.DeepEqual(plan.Problems, []error(planErr)) {
+		t.Error("Expecting the plan to hold the problems")
+	}
+	if len(plan.Order) != 3 {
+		t.Error("Expecting base, auth-ldap and auth-saml in order, got", plan.Order)
+	}
+	if !strings.Contains(plan.String(), "Problems:\n  Cannot resolve plugin [ orphan 1.0.0 ]") {
+		t.Error("Unexpected plan\n", plan)
+	}
+
+	// Load fails on the first one
+	_, _, err = loader.Load(context.Background(), plugins, registerFunc(t))
+	if _, ok := err.(loader.UnresolvedDependenciesLoadError); !ok {
+		t.Error("Expecting UnresolvedDependenciesLoadError, got", err)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "maven", "1.0.1", "base [1.0.0,2.0.0)"),
+		requires(t, "maven", "1.0.2", "base [1.0.0,2.0.0)"),
+	}
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := loaded.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `digraph plugins {
+  node [shape=box, style=filled];
+  "base@1.0.0" [label="base 1.0.0\nDependentsRegistered", fillcolor="palegreen"];
+  "maven@1.0.1" [label="maven 1.0.1\nShadowed", fillcolor="gray80"];
+  "maven@1.0.2" [label="maven 1.0.2\nDependentsRegistered", fillcolor="palegreen"];
+  "maven@1.0.2" -> "base@1.0.0" [label="[1.0.0,2.0.0)"];
+}
+`
+	if b.String() != expected {
+		t.Error("Unexpected DOT\n", b.String())
+	}
+}
+
+func TestWriteJSONUnresolved(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "maven", "1.0.0", "base [1.0.0,2.0.0)", "missing ^1"),
+	}
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t))
+	if _, ok := err.(loader.UnresolvedDependenciesLoadError); !ok {
+		t.Fatal("Expecting UnresolvedDependenciesLoadError, got", err)
+	}
+
+	var b strings.Builder
+	if err := loaded.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var g loader.Graph
+	if err := json.Unmarshal([]byte(b.String()), &g); err != nil {
+		t.Fatal(err)
+	}
+
+	var states []string
+	for _, n := range g.Nodes {
+		states = append(states, n.ID+" "+n.State)
+	}
+	if fmt.Sprint(states) != "[base@1.0.0 Unregistered maven@1.0.0 Unresolved missing:missing Unresolved]" {
+		t.Error("Unexpected nodes", states)
+	}
+	if len(g.Edges) != 2 || g.Edges[0].Missing || g.Edges[0].To != "base@1.0.0" ||
+		!g.Edges[1].Missing || g.Edges[1].To != "missing:missing" ||
+		g.Edges[1].Dependency.String() != "missing [1.0.0,2.0.0-0)" {
+		t.Error("Unexpected edges", g.Edges)
+	}
+}
+
+func TestLoadParallel(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "a", "1.0.0", "base [1.0.0,2.0.0)"),
+		requires(t, "b", "1.0.0", "base [1.0.0,2.0.0)"),
+		requires(t, "c", "1.0.0", "a ^1", "b ^1"),
+	}
+
+	var mu sync.Mutex
+	var registered = map[plugin.ID]bool{}
+	// a and b each wait for the other to start, which only works if they run concurrently
+	var started = map[plugin.ID]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	register := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		id := lp.Plugin().ID()
+		if ch, ok := started[id]; ok {
+			close(ch)
+			other := map[plugin.ID]plugin.ID{"a": "b", "b": "a"}[id]
+			select {
+			case <-started[other]:
+			case <-time.After(5 * time.Second):
+				return ctx, fmt.Errorf("%s was not started alongside %s", id, other)
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for d := range lp.Dependencies() {
+			if !registered[d.ID] {
+				return ctx, fmt.Errorf("%s registered before its dependency %s", id, d.ID)
+			}
+		}
+		registered[id] = true
+		return context.WithValue(ctx, id, true), nil
+	}
+
+	ctx, loaded, err := loader.Load(context.Background(), plugins, register, loader.WithParallelism(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 4 || loaded.Get(0).Plugin().ID() != "base" || loaded.Get(3).Plugin().ID() != "c" {
+		t.Error("Unexpected registration order", loadedVersions(loaded))
+	}
+	for i := 0; i < loaded.Count(); i++ {
+		if loaded.Get(i).State() != loader.DependentsRegistered {
+			t.Error("Unexpected state", loaded.Get(i).Plugin().ID(), loaded.Get(i).State())
+		}
+	}
+
+	if _, err := loaded.Unload(ctx, unregisterFunc(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadParallelRollback(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin,
+		requires(t, "a", "1.0.0", "base [1.0.0,2.0.0)"),
+		requires(t, "failing", "1.0.0", "base [1.0.0,2.0.0)"),
+		requires(t, "c", "1.0.0", "failing ^1"),
+	}
+
+	var mu sync.Mutex
+	var unregistered []plugin.ID
+	register := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		switch lp.Plugin().ID() {
+		case "failing":
+			return ctx, errors.New("cannot start")
+		case "c":
+			t.Error("c should not be registered")
+		}
+		return ctx, nil
+	}
+	unregister := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		unregistered = append(unregistered, lp.Plugin().ID())
+		return ctx, nil
+	}
+
+	_, loaded, err := loader.Load(context.Background(), plugins, register, loader.WithParallelism(0), loader.WithRollback(unregister))
+	rollbackErr, ok := err.(loader.RollbackLoadError)
+	if !ok {
+		t.Fatal("Expecting RollbackLoadError, got", err)
+	}
+	if rollbackErr.Plugin.ID() != "failing" || rollbackErr.Err.Error() != "cannot start" {
+		t.Error("Unexpected error", rollbackErr)
+	}
+	if len(unregistered) != 3 || unregistered[2] != "base" || loaded.Count() != 0 {
+		t.Error("Expecting a, failing and base to be unregistered, got", unregistered)
+	}
+}
+
+func TestLoadStartTimeout(t *testing.T) {
+	slow := plugin.Manifest{ID: "slow", Version: harness.V1_0_0, Dependencies: harness.MavenPlugin.Dependencies(),
+		StartTimeout: plugin.Duration(20 * time.Millisecond)}.Plugin()
+	var plugins = []plugin.Plugin{harness.BasePlugin, slow}
+
+	hang := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		if lp.Plugin().ID() == "slow" {
+			<-ctx.Done()
+		}
+		return ctx, nil
+	}
+
+	// The plugin's own timeout wins over the default
+	start := time.Now()
+	_, _, err := loader.Load(context.Background(), plugins, hang, loader.WithStartTimeout(time.Hour))
+	var timeoutErr loader.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatal("Expecting TimeoutError, got", err)
+	}
+	if timeoutErr.Plugin.ID() != "slow" || timeoutErr.Timeout != 20*time.Millisecond || timeoutErr.Op != "register" {
+		t.Error("Unexpected error", timeoutErr)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("Timeout not applied")
+	}
+	if !strings.Contains(err.Error(), "Plugin [ slow 1.0.0 ]: register timed out after 20ms") {
+		t.Error("Unexpected message", err)
+	}
+
+	// The context returned by a plugin is not cancelled along with its timeout
+	var values []interface{}
+	register := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		if ctx.Err() != nil {
+			return ctx, ctx.Err()
+		}
+		values = append(values, ctx.Value(plugin.ID("base")))
+		return context.WithValue(ctx, lp.Plugin().ID(), true), nil
+	}
+	plugins = []plugin.Plugin{harness.BasePlugin, harness.MavenPlugin}
+	if _, _, err := loader.Load(context.Background(), plugins, register, loader.WithStartTimeout(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != "[<nil> true]" {
+		t.Error("Expecting maven to see the value set by base, got", values)
+	}
+}
+
+func TestLoadCancelled(t *testing.T) {
+	var cancel context.CancelFunc
+	var registered []plugin.ID
+	register := func(c context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		registered = append(registered, lp.Plugin().ID())
+		cancel()
+		return c, nil
+	}
+	var unregistered []plugin.ID
+	unregister := func(c context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		unregistered = append(unregistered, lp.Plugin().ID())
+		return c, c.Err()
+	}
+
+	for _, opts := range [][]loader.Option{{}, {loader.WithParallelism(2)}} {
+		registered, unregistered = nil, nil
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		plugins := []plugin.Plugin{harness.BasePlugin, harness.MavenPlugin}
+		_, loaded, err := loader.Load(ctx, plugins, register, append(opts, loader.WithRollback(unregister))...)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("Expecting context.Canceled, got", err)
+		}
+		if fmt.Sprint(registered) != "[base]" || loaded.Count() != 0 {
+			t.Error("Expecting only base to be registered, got", registered)
+		}
+		if fmt.Sprint(unregistered) != "[base]" {
+			t.Error("Expecting base to be unregistered despite the cancellation, got", unregistered)
+		}
+		cancel()
+	}
+}
+
+func TestUnloadStopTimeout(t *testing.T) {
+	var plugins = []plugin.Plugin{harness.BasePlugin, harness.MavenPlugin}
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t), loader.WithStopTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hang := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		if lp.Plugin().ID() == "maven" {
+			<-ctx.Done()
+		}
+		return ctx, nil
+	}
+	_, err = loaded.Unload(context.Background(), hang)
+	var timeoutErr loader.TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Plugin.ID() != "maven" || timeoutErr.Op != "unregister" {
+		t.Fatal("Expecting maven to time out, got", err)
+	}
+	// Unload stops at the plugin that failed, it can be retried
+	if loaded.Count() != 2 {
+		t.Error("Expecting both plugins still loaded, got", loaded.Count())
+	}
+	if _, err = loaded.Unload(context.Background(), unregisterFunc(t)); err != nil || loaded.Count() != 0 {
+		t.Error("Expecting unload to succeed, got", err)
+	}
+}
+
+func TestUnloadWhere(t *testing.T) {
+	var plugins = []plugin.Plugin{
+		harness.BasePlugin, harness.MavenPlugin,
+		requires(t, "maven-test", "1.0.0", "maven [1.0.0,2.0.0)"),
+	}
+	var r recorder
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t), loader.WithStopTimeout(20*time.Millisecond), loader.WithObserver(&r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.events = nil
+
+	hang := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		if lp.Plugin().ID() == "maven" {
+			<-ctx.Done()
+		}
+		return ctx, nil
+	}
+	_, errs := loaded.UnloadWhere(context.Background(), func(lp *loader.LoadedPlugin) bool {
+		return lp.Plugin().ID() != "base"
+	}, hang)
+
+	// Keeps going past the plugin that timed out, dependents first
+	var timeoutErr loader.TimeoutError
+	if len(errs) != 1 || !errors.As(errs[0].Err, &timeoutErr) || errs[0].Plugin.ID() != "maven" {
+		t.Fatal("Expecting maven to time out, got", errs)
+	}
+	expected := []string{
+		"stopping maven-test", "stopped maven-test <nil>",
+		"stopping maven", fmt.Sprint("stopped maven ", timeoutErr),
+	}
+	if !reflect.DeepEqual(r.events, expected) {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, r.events)
+	}
+	if loaded.Count() != 1 || loaded.Get(0).Plugin().ID() != "base" {
+		t.Error("Expecting only base to stay loaded, got", loaded.Count())
+	}
+}
+
+// recorder is an Observer that records the events it is given
+type recorder struct {
+	loader.DefaultObserver
+	events []string
+}
+
+func (r *recorder) Resolving(plugins []plugin.Plugin) {
+	var ids []plugin.ID
+	for _, p := range plugins {
+		ids = append(ids, p.ID())
+	}
+	r.events = append(r.events, fmt.Sprint("resolving ", ids))
+}
+
+func (r *recorder) Resolved(state *loader.LoadedPlugins, err error) {
+	r.events = append(r.events, fmt.Sprint("resolved ", err))
+}
+
+func (r *recorder) Starting(lp *loader.LoadedPlugin) {
+	r.events = append(r.events, fmt.Sprint("starting ", lp.Plugin().ID()))
+}
+
+func (r *recorder) Started(lp *loader.LoadedPlugin, elapsed time.Duration) {
+	r.events = append(r.events, fmt.Sprint("started ", lp.Plugin().ID()))
+}
+
+func (r *recorder) Failed(lp *loader.LoadedPlugin, err error) {
+	r.events = append(r.events, fmt.Sprint("failed ", lp.Plugin().ID(), " ", err))
+}
+
+func (r *recorder) Stopping(lp *loader.LoadedPlugin) {
+	r.events = append(r.events, fmt.Sprint("stopping ", lp.Plugin().ID()))
+}
+
+func (r *recorder) Stopped(lp *loader.LoadedPlugin, elapsed time.Duration, err error) {
+	r.events = append(r.events, fmt.Sprint("stopped ", lp.Plugin().ID(), " ", err))
+}
+
+func (r *recorder) StateChanged(lp *loader.LoadedPlugin, state loader.RegistrationState) {
+	r.events = append(r.events, fmt.Sprint(lp.Plugin().ID(), " ", state))
+}
+
+func TestObserver(t *testing.T) {
+	var plugins = []plugin.Plugin{harness.MavenPlugin, harness.BasePlugin}
+	var r recorder
+
+	_, loaded, err := loader.Load(context.Background(), plugins, registerFunc(t), loader.WithObserver(&r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Unload(context.Background(), unregisterFunc(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"resolving [maven base]", "resolved <nil>",
+		"base DependenciesRegistered", "starting base", "started base", "base PluginRegistered",
+		"maven DependenciesRegistered", "starting maven", "started maven", "maven PluginRegistered",
+		"maven DependentsRegistered", "base DependentsRegistered",
+		"stopping maven", "stopped maven <nil>", "stopping base", "stopped base <nil>",
+	}
+	if !reflect.DeepEqual(r.events, expected) {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, r.events)
+	}
+}
+
+func TestObserverFailed(t *testing.T) {
+	var plugins = []plugin.Plugin{harness.MavenPlugin, harness.BasePlugin}
+	failing := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+		if lp.Plugin().ID() == "maven" {
+			return ctx, errors.New("broken")
+		}
+		return ctx, nil
+	}
+
+	for _, opts := range [][]loader.Option{{}, {loader.WithParallelism(0)}} {
+		var r recorder
+		opts = append(opts, loader.WithObserver(&r), loader.WithRollback(func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+			return ctx, nil
+		}))
+		if _, _, err := loader.Load(context.Background(), plugins, failing, opts...); err == nil {
+			t.Fatal("Expecting an error")
+		}
+		expected := []string{
+			"resolving [maven base]", "resolved <nil>",
+			"base DependenciesRegistered", "starting base", "started base", "base PluginRegistered",
+			"maven DependenciesRegistered", "starting maven", "failed maven broken",
+			"stopping maven", "stopped maven <nil>", "stopping base", "stopped base <nil>",
+		}
+		if !reflect.DeepEqual(r.events, expected) {
+			t.Errorf("Expected\n%v\ngot\n%v", expected, r.events)
+		}
+	}
+
+	// Nothing is registered if the plugins cannot be resolved
+	var r recorder
+	_, _, err := loader.Load(context.Background(), []plugin.Plugin{harness.MavenPlugin}, registerFunc(t), loader.WithObserver(&r))
+	if err == nil || len(r.events) != 2 || r.events[1] != fmt.Sprint("resolved ", err) {
+		t.Error("Expecting only the resolving and resolved events, got", r.events)
+	}
+}
+
+func TestObserverCancelled(t *testing.T) {
+	var plugins = []plugin.Plugin{harness.MavenPlugin, harness.BasePlugin}
+
+	for _, opts := range [][]loader.Option{{}, {loader.WithParallelism(0)}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelling := func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+			cancel()
+			return ctx, nil
+		}
+		var r recorder
+		opts = append(opts, loader.WithObserver(&r), loader.WithRollback(func(ctx context.Context, lp *loader.LoadedPlugin) (context.Context, error) {
+			return ctx, nil
+		}))
+		if _, _, err := loader.Load(ctx, plugins, cancelling, opts...); err == nil {
+			t.Fatal("Expecting an error")
+		}
+		expected := []string{
+			"resolving [maven base]", "resolved <nil>",
+			"base DependenciesRegistered", "starting base", "started base", "base PluginRegistered",
+			"failed maven context canceled",
+			"stopping base", "stopped base <nil>",
+		}
+		if !reflect.DeepEqual(r.events, expected) {
+			t.Errorf("Expected\n%v\ngot\n%v", expected, r.events)
+		}
+	}
+}
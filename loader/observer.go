@@ -0,0 +1,89 @@
+package loader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+type (
+	// Observer is told about the progress of Load and Unload, e.g. to log, time or show the
+	// startup of plugins, see WithObserver. Embed DefaultObserver to implement only some of
+	// the methods.
+	//
+	// Calls are made one at a time, even with WithParallelism, so an Observer need not be safe
+	// for concurrent use. They are made while loading, so they should return quickly.
+	Observer interface {
+		// Resolving is called by Load with the plugins it was given, before anything is resolved
+		Resolving(plugins []plugin.Plugin)
+		// Resolved is called once the plugins to register are picked and linked, err is the first
+		// problem found, in which case nothing is registered
+		Resolved(state *LoadedPlugins, err error)
+		// Starting is called before the RegisterFunc of a plugin
+		Starting(lp *LoadedPlugin)
+		// Started is called after the RegisterFunc of a plugin succeeded, with the time it took
+		Started(lp *LoadedPlugin, elapsed time.Duration)
+		// Failed is called after the RegisterFunc of a plugin failed or timed out, or instead of
+		// it if Load was cancelled before the plugin was started
+		Failed(lp *LoadedPlugin, err error)
+		// Stopping is called before the UnregisterFunc of a plugin, when rolling back or in Unload
+		Stopping(lp *LoadedPlugin)
+		// Stopped is called after the UnregisterFunc of a plugin, with the time it took and its error
+		Stopped(lp *LoadedPlugin, elapsed time.Duration, err error)
+		// StateChanged is called each time a plugin being registered enters a RegistrationState
+		StateChanged(lp *LoadedPlugin, state RegistrationState)
+	}
+
+	// DefaultObserver ignores every event
+	DefaultObserver struct{}
+
+	// observers passes events on to every Observer given to Load, one event at a time
+	observers struct {
+		list []Observer
+		mu   *sync.Mutex
+	}
+)
+
+func (DefaultObserver) Resolving(plugins []plugin.Plugin)                          {}
+func (DefaultObserver) Resolved(state *LoadedPlugins, err error)                   {}
+func (DefaultObserver) Starting(lp *LoadedPlugin)                                  {}
+func (DefaultObserver) Started(lp *LoadedPlugin, elapsed time.Duration)            {}
+func (DefaultObserver) Failed(lp *LoadedPlugin, err error)                         {}
+func (DefaultObserver) Stopping(lp *LoadedPlugin)                                  {}
+func (DefaultObserver) Stopped(lp *LoadedPlugin, elapsed time.Duration, err error) {}
+func (DefaultObserver) StateChanged(lp *LoadedPlugin, state RegistrationState)     {}
+
+// WithObserver has Load call the Observer as it goes, and Unload of the LoadedPlugins it
+// returns. It can be given more than once, observers are called in the order given.
+func WithObserver(observer Observer) Option {
+	return func(o *loadOptions) {
+		if o.observers.mu == nil {
+			o.observers.mu = &sync.Mutex{}
+		}
+		o.observers.list = append(o.observers.list, observer)
+	}
+}
+
+func (o observers) notify(event func(Observer)) {
+	if len(o.list) == 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, observer := range o.list {
+		event(observer)
+	}
+}
+
+// cancel stops Load at a plugin it was about to start, as ctx is done with err
+func (state *LoadedPlugins) cancel(n *LoadedPlugin, err error) {
+	state.failed = n
+	state.options.observers.notify(func(o Observer) { o.Failed(n, err) })
+}
+
+// setState moves a plugin being registered to a new state
+func (state *LoadedPlugins) setState(n *LoadedPlugin, s RegistrationState) {
+	n.state = s
+	state.options.observers.notify(func(o Observer) { o.StateChanged(n, s) })
+}
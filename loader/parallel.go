@@ -0,0 +1,85 @@
+package loader
+
+import (
+	"context"
+)
+
+// registered is the outcome of a RegisterFunc run by registerParallel
+type registered struct {
+	node *LoadedPlugin
+	ctx  context.Context
+	err  error
+}
+
+// registerParallel registers the nodes concurrently, see WithParallelism. Plugins are added to
+// state.loaded in the order their RegisterFunc is called. Only this function changes the state
+// of the nodes, the RegisterFuncs run in their own goroutines.
+func registerParallel(state *LoadedPlugins, ctx context.Context, RegisterFunc RegisterFunc, nodes pluginList, max int) error {
+	var waiting = map[*LoadedPlugin]int{}
+	var contexts = map[*LoadedPlugin]context.Context{}
+	var ready = pluginList{}
+
+	for _, n := range nodes {
+		waiting[n] = len(n.dependencies)
+		if waiting[n] == 0 {
+			ready = append(ready, n)
+			contexts[n] = ctx
+		}
+	}
+
+	var results = make(chan registered)
+	var running = 0
+	var firstErr error
+
+	for {
+		if firstErr == nil && len(ready) > 0 {
+			if err := ctx.Err(); err != nil {
+				firstErr = err
+				state.cancel(ready[0], err)
+			}
+		}
+		for firstErr == nil && len(ready) > 0 && (max <= 0 || running < max) {
+			n := ready[0]
+			ready = ready[1:]
+
+			state.loaded = append(state.loaded, n)
+			state.setState(n, DependenciesRegistered)
+			running++
+			go func(n *LoadedPlugin, ctx context.Context) {
+				ctx, err := state.register(ctx, RegisterFunc, n)
+				results <- registered{node: n, ctx: ctx, err: err}
+			}(n, contexts[n])
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+				state.failed = r.node
+			}
+			continue
+		}
+		state.setState(r.node, PluginRegistered)
+
+		for _, d := range r.node.dependents {
+			waiting[d]--
+			contexts[d] = r.ctx
+			if waiting[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	for _, n := range state.loaded {
+		state.setState(n, DependentsRegistered)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+type (
+	// Link is a dependency of a plugin and the plugin that satisfies it
+	Link struct {
+		Plugin     plugin.Plugin
+		Dependency plugin.Dependency
+		Provider   plugin.Plugin
+	}
+
+	// LoadPlan describes what Load would do with a set of plugins, without registering any
+	LoadPlan struct {
+		// Order lists the plugins in the order they would be registered. If there are
+		// problems, plugins that cannot be ordered, those with unresolved dependencies or in a
+		// cycle and their dependents, are left out. Plugins that conflict are listed, each of
+		// them could be registered without the other.
+		Order []plugin.Plugin
+		// Links has the provider of each dependency of the plugins in Order, in the
+		// order declared. Optional dependencies that are not present are left out.
+		Links []Link
+		// Unused lists the plugins in Order that no other plugin depends on
+		Unused []plugin.Plugin
+		// Shadowed lists the plugins that would not be registered because another
+		// version of the same plugin was picked
+		Shadowed []plugin.Plugin
+		// Replaced lists the plugins that would not be registered because another
+		// plugin replaces them
+		Replaced []plugin.Plugin
+		// Problems lists every reason Load would fail, in the order Load checks for them
+		Problems []error
+	}
+
+	// PlanError is returned by Plan with every problem found
+	PlanError []error
+)
+
+// Plan resolves and orders the plugins like Load, but does not register any of them.
+// Unlike Load it does not stop at the first problem. If there are problems, the LoadPlan is
+// returned together with a PlanError listing them.
+func Plan(plugins []plugin.Plugin, opts ...Option) (*LoadPlan, error) {
+	var options loadOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	state, _, problems := resolve(plugins, options)
+
+	// Order the plugins the way Load would, registering nothing
+	noop := func(ctx context.Context, n *LoadedPlugin) (context.Context, error) {
+		return ctx, nil
+	}
+	flattenRoots(state, context.Background(), noop)
+
+	var plan = &LoadPlan{
+		Order:    state.loaded.plugins(),
+		Links:    []Link{},
+		Unused:   []plugin.Plugin{},
+		Shadowed: state.shadowed.plugins(),
+		Replaced: state.replaced.plugins(),
+		Problems: problems,
+	}
+	for _, n := range state.loaded {
+		for _, d := range n.plugin.Dependencies() {
+			if dn, ok := n.dependencies[d]; ok {
+				plan.Links = append(plan.Links, Link{Plugin: n.plugin, Dependency: d, Provider: dn.plugin})
+			}
+		}
+		if len(n.dependents) == 0 {
+			plan.Unused = append(plan.Unused, n.plugin)
+		}
+	}
+
+	if len(problems) != 0 {
+		return plan, PlanError(problems)
+	}
+	return plan, nil
+}
+
+func (e PlanError) Error() string {
+	var strs = make([]string, len(e))
+	for i, err := range e {
+		strs[i] = err.Error()
+	}
+	return strings.Join(strs, "\n")
+}
+
+func (l Link) String() string {
+	return fmt.Sprintf("%s %s -> %s: %s %s",
+		l.Plugin.ID(), l.Plugin.Version(), l.Dependency.String(), l.Provider.ID(), l.Provider.Version())
+}
+
+// String formats the plan for people to read, e.g. in the output of a CI job
+func (p *LoadPlan) String() string {
+	var b strings.Builder
+	section := func(title string, plugins []plugin.Plugin) {
+		if len(plugins) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "%s:\n", title)
+		for _, pl := range plugins {
+			fmt.Fprintf(&b, "  %s %s\n", pl.ID(), pl.Version())
+		}
+	}
+
+	section("Order", p.Order)
+	if len(p.Links) != 0 {
+		fmt.Fprintln(&b, "Links:")
+		for _, l := range p.Links {
+			fmt.Fprintf(&b, "  %s\n", l)
+		}
+	}
+	section("Unused", p.Unused)
+	section("Shadowed", p.Shadowed)
+	section("Replaced", p.Replaced)
+	if len(p.Problems) != 0 {
+		fmt.Fprintln(&b, "Problems:")
+		for _, err := range p.Problems {
+			fmt.Fprintf(&b, "  %s\n", strings.TrimRight(strings.ReplaceAll(err.Error(), "\n", "\n  "), " "))
+		}
+	}
+	return b.String()
+}
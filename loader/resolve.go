@@ -0,0 +1,484 @@
+package loader
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+type (
+	// Requirement is a dependency declared by a particular plugin version
+	Requirement struct {
+		Plugin     plugin.Plugin
+		Dependency plugin.Dependency
+	}
+
+	// VersionConflictLoadError is returned if each plugin can be resolved on its own, but there
+	// is no way to pick one version of every plugin that satisfies all the dependencies at once.
+	// Only a minimal set of conflicting plugins is reported: dropping any one of them would
+	// remove the conflict.
+	VersionConflictLoadError struct {
+		// IDs of the conflicting plugins
+		IDs []plugin.ID
+		// Requirements between the conflicting plugins
+		Requirements []Requirement
+		// Candidates are the versions available for each of the conflicting plugins
+		Candidates map[plugin.ID][]plugin.Plugin
+	}
+
+	// resolver picks one version for each plugin ID
+	resolver struct {
+		// candidates for each plugin ID, highest version first
+		candidates map[plugin.ID]pluginList
+		ids        []plugin.ID
+		// replaced are the IDs that some candidate replaces
+		replaced map[plugin.ID]bool
+		// preferred provider ID for a capability
+		preferred map[plugin.ID]plugin.ID
+	}
+
+	selection map[plugin.ID]*LoadedPlugin
+)
+
+// Error explains the conflict
+func (e VersionConflictLoadError) Error() string {
+	str := fmt.Sprintf("No combination of versions satisfies all dependencies between %v\n", e.IDs)
+	for _, r := range e.Requirements {
+		str = fmt.Sprintf("%s %s %s requires %s\n", str, r.Plugin.ID(), r.Plugin.Version(), r.Dependency.String())
+	}
+	for i, a := range e.Requirements {
+		for _, b := range e.Requirements[i+1:] {
+			if a.Dependency.ID == b.Dependency.ID && a.Plugin.ID() != b.Plugin.ID() {
+				str += e.explain(a, b)
+			}
+		}
+	}
+	for _, id := range e.IDs {
+		str = fmt.Sprintf("%s Candidates for %s:", str, id)
+		for _, p := range e.Candidates[id] {
+			str = fmt.Sprintf("%s %s", str, p.Version())
+		}
+		str += "\n"
+	}
+	return str
+}
+
+// explain compares two requirements on the same plugin
+func (e VersionConflictLoadError) explain(a, b Requirement) string {
+	str := fmt.Sprintf(" %s needs %s %s but %s needs %s; ",
+		a.Plugin.ID(), a.Dependency.ID, dependencyString(a.Dependency), b.Plugin.ID(), dependencyString(b.Dependency))
+
+	common := intersectRanges(dependencyRanges(a.Dependency), dependencyRanges(b.Dependency))
+	if len(common) == 0 {
+		return str + "they do not overlap\n"
+	}
+
+	var strs = make([]string, len(common))
+	for i, r := range common {
+		strs[i] = r.String()
+	}
+	str += fmt.Sprintf("their intersection is %s", strings.Join(strs, " || "))
+
+	for _, c := range e.Candidates[a.Dependency.ID] {
+		for _, r := range common {
+			if c.Version().IsWithin(r) {
+				return str + "\n"
+			}
+		}
+	}
+	return str + ", which no candidate is within\n"
+}
+
+func dependencyString(d plugin.Dependency) string {
+	return strings.TrimPrefix(d.String(), string(d.ID)+" ")
+}
+
+// dependencyRanges returns the ranges of versions a dependency allows
+func dependencyRanges(d plugin.Dependency) []plugin.Range {
+	switch c := d.Constraint.(type) {
+	case nil:
+		return []plugin.Range{d.Range}
+	case plugin.Range:
+		return []plugin.Range{c}
+	case *plugin.RangeSet:
+		return c.Ranges
+	default:
+		return nil
+	}
+}
+
+// intersectRanges returns the ranges of versions allowed by both sets of ranges
+func intersectRanges(a, b []plugin.Range) []plugin.Range {
+	var common []plugin.Range
+	for _, ra := range a {
+		for _, rb := range b {
+			if i := ra.Intersect(rb); !i.IsEmpty() {
+				common = append(common, i)
+			}
+		}
+	}
+	return common
+}
+
+// replaces is true if the plugin replaces some of the versions the dependency allows
+func replaces(p plugin.Plugin, d plugin.Dependency) bool {
+	if d.Capability {
+		return false
+	}
+	for _, e := range plugin.ReplacesOf(p) {
+		if e.ID == d.ID && len(intersectRanges(dependencyRanges(e), dependencyRanges(d))) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// findReplaced returns the plugins whose version is replaced by another plugin in the list
+func findReplaced(nodes pluginList) pluginList {
+	var replaced = pluginList{}
+	for _, n := range nodes {
+		for _, o := range nodes {
+			if o.plugin.ID() != n.plugin.ID() && isReplacedBy(n.plugin, o.plugin) {
+				replaced = append(replaced, n)
+				break
+			}
+		}
+	}
+	return replaced
+}
+
+func isReplacedBy(p plugin.Plugin, by plugin.Plugin) bool {
+	for _, e := range plugin.ReplacesOf(by) {
+		if plugin.Satisfies(p, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// providers lists the candidates that can be linked to a dependency, in order of preference.
+// Versions of the plugin itself come first, highest version first, then the plugins replacing it.
+// For a capability, see capabilityProviders.
+func (r *resolver) providers(d plugin.Dependency) pluginList {
+	if d.Capability {
+		return r.capabilityProviders(d)
+	}
+
+	var list = pluginList{}
+	for _, n := range r.candidates[d.ID] {
+		if plugin.Satisfies(n.plugin, d) {
+			list = append(list, n)
+		}
+	}
+	for _, id := range r.ids {
+		if id == d.ID {
+			continue
+		}
+		for _, n := range r.candidates[id] {
+			if replaces(n.plugin, d) {
+				list = append(list, n)
+			}
+		}
+	}
+	return list
+}
+
+// capabilityProviders lists the candidates providing the capability a dependency allows.
+// The preferred provider comes first, if any, then the highest version of the capability.
+// Ties are broken by plugin ID, then by the highest plugin version.
+func (r *resolver) capabilityProviders(d plugin.Dependency) pluginList {
+	var list = pluginList{}
+	var version = map[*LoadedPlugin]plugin.Version{}
+	for _, id := range r.ids {
+		for _, n := range r.candidates[id] {
+			for _, c := range plugin.ProvidesOf(n.plugin) {
+				if c.Name != d.ID || !d.Allows(c.Version) {
+					continue
+				}
+				if v, ok := version[n]; !ok {
+					list = append(list, n)
+					version[n] = c.Version
+				} else if c.Version.Compare(v) > 0 {
+					version[n] = c.Version
+				}
+			}
+		}
+	}
+
+	preferred := r.preferred[d.ID]
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if pa, pb := a.plugin.ID() == preferred, b.plugin.ID() == preferred; pa != pb {
+			return pa
+		}
+		if c := version[a].Compare(version[b]); c != 0 {
+			return c > 0
+		}
+		// Otherwise already in order of plugin ID and highest version
+		return false
+	})
+	return list
+}
+
+// isViable is true if every mandatory dependency of the plugin can be linked to at least one candidate
+func (r *resolver) isViable(n *LoadedPlugin) bool {
+	for _, d := range n.plugin.Dependencies() {
+		if !d.Optional && len(r.providers(d)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// newResolver discards the versions that can never be picked because one of their
+// dependencies cannot be satisfied. The discarded versions are returned as well.
+func newResolver(all map[plugin.ID]pluginList, preferred map[plugin.ID]plugin.ID) (*resolver, pluginList) {
+	var r = &resolver{
+		candidates: map[plugin.ID]pluginList{},
+		replaced:   map[plugin.ID]bool{},
+		preferred:  preferred,
+	}
+	var discarded = pluginList{}
+
+	for id, versions := range all {
+		r.candidates[id] = append(pluginList{}, versions...)
+		r.ids = append(r.ids, id)
+	}
+
+	// Deterministic, whatever order the plugins were given in
+	sort.Slice(r.ids, func(i, j int) bool { return r.ids[i] < r.ids[j] })
+	for _, versions := range r.candidates {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].plugin.Version().Compare(versions[j].plugin.Version()) > 0
+		})
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, id := range r.ids {
+			viable := pluginList{}
+			for _, n := range r.candidates[id] {
+				if r.isViable(n) {
+					viable = append(viable, n)
+				} else {
+					discarded = append(discarded, n)
+					changed = true
+				}
+			}
+			r.candidates[id] = viable
+		}
+	}
+
+	// Plugins without any viable version cannot be picked, see resolve for whether that is an error
+	var ids = []plugin.ID{}
+	for _, id := range r.ids {
+		if len(r.candidates[id]) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	r.ids = ids
+
+	for _, versions := range r.candidates {
+		for _, n := range versions {
+			for _, e := range plugin.ReplacesOf(n.plugin) {
+				r.replaced[e.ID] = true
+			}
+		}
+	}
+
+	return r, discarded
+}
+
+// consistent checks a candidate against the versions selected so far.
+// Only dependencies between plugins in scope are considered. Optional dependencies never
+// constrain the selection, they are linked afterwards if the selected version satisfies them.
+// Dependencies on capabilities and replaced plugins are only checked once complete.
+func (r *resolver) consistent(candidate *LoadedPlugin, selected selection, scope map[plugin.ID]bool) bool {
+	for _, d := range candidate.plugin.Dependencies() {
+		if d.Optional || d.Capability {
+			continue
+		}
+		if s, ok := selected[d.ID]; ok && scope[d.ID] && !r.replaced[d.ID] && !plugin.Satisfies(s.plugin, d) {
+			return false
+		}
+	}
+
+	id := candidate.plugin.ID()
+	if r.replaced[id] {
+		// Dependencies on it may be satisfied by a replacement instead, see complete
+		return true
+	}
+	for _, s := range selected {
+		for _, d := range s.plugin.Dependencies() {
+			if d.ID == id && !d.Optional && !d.Capability && !plugin.Satisfies(candidate.plugin, d) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// complete checks that every mandatory dependency of the selected versions can be linked,
+// to a version of the plugin itself, a replacement or a capability provider. A dependency is
+// ignored if none of the plugins that could satisfy it are in scope.
+func (r *resolver) complete(selected selection, scope map[plugin.ID]bool) bool {
+	for _, s := range selected {
+		for _, d := range s.plugin.Dependencies() {
+			if d.Optional || r.provider(selected, d) != nil {
+				continue
+			}
+			for _, p := range r.providers(d) {
+				if scope[p.plugin.ID()] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// solve picks a version for each of the plugin IDs, trying higher versions first and
+// backtracking when a choice conflicts with a later one. Returns nil if there is no solution.
+func (r *resolver) solve(ids []plugin.ID) selection {
+	var scope = map[plugin.ID]bool{}
+	for _, id := range ids {
+		scope[id] = true
+	}
+
+	var selected = selection{}
+	var assign func(i int) bool
+	assign = func(i int) bool {
+		if i == len(ids) {
+			return r.complete(selected, scope)
+		}
+		id := ids[i]
+		for _, c := range r.candidates[id] {
+			if r.consistent(c, selected, scope) {
+				selected[id] = c
+				if assign(i + 1) {
+					return true
+				}
+				delete(selected, id)
+			}
+		}
+		return false
+	}
+
+	if !assign(0) {
+		return nil
+	}
+	return selected
+}
+
+// conflict finds a minimal set of plugin IDs that cannot be solved together
+// by dropping IDs for as long as the rest is still unsolvable.
+func (r *resolver) conflict() VersionConflictLoadError {
+	var core = append([]plugin.ID{}, r.ids...)
+
+	for i := 0; i < len(core); {
+		without := append(append([]plugin.ID{}, core[:i]...), core[i+1:]...)
+		if r.solve(without) == nil {
+			core = without
+		} else {
+			i++
+		}
+	}
+
+	var e = VersionConflictLoadError{
+		IDs:        core,
+		Candidates: map[plugin.ID][]plugin.Plugin{},
+	}
+	var inCore = map[plugin.ID]bool{}
+	for _, id := range core {
+		inCore[id] = true
+	}
+	for _, id := range core {
+		e.Candidates[id] = r.candidates[id].plugins()
+		for _, n := range r.candidates[id] {
+			for _, d := range n.plugin.Dependencies() {
+				if inCore[d.ID] && !d.Optional && !d.Capability {
+					e.Requirements = append(e.Requirements, Requirement{Plugin: n.plugin, Dependency: d})
+				}
+			}
+		}
+	}
+	return e
+}
+
+// provider returns the selected plugin to link a dependency to, the first of its providers
+// that is selected. Returns nil if there is none.
+func (r *resolver) provider(s selection, d plugin.Dependency) *LoadedPlugin {
+	for _, n := range r.providers(d) {
+		if s[n.plugin.ID()] == n {
+			return n
+		}
+	}
+	return nil
+}
+
+// link connects the selected plugins to the selected versions of their dependencies, to
+// their replacements or to capability providers. Optional dependencies are only linked if
+// the selection satisfies them. Returns the selected plugins in the order given.
+func (r *resolver) link(s selection, nodes pluginList) pluginList {
+	var linked = pluginList{}
+	for _, n := range nodes {
+		if s[n.plugin.ID()] != n {
+			continue
+		}
+		linked = append(linked, n)
+		for _, d := range n.plugin.Dependencies() {
+			dn := r.provider(s, d)
+			if dn == nil {
+				// An optional dependency that is not present
+				continue
+			}
+			n.dependencies[d] = dn
+			dn.dependents = append(dn.dependents, n)
+		}
+	}
+	return linked
+}
+
+// linkHighest connects each viable plugin to the first provider of each of its dependencies,
+// the highest version satisfying it if there is one, allowing several versions of a plugin.
+// Optional dependencies that nothing satisfies are left out. Returns the viable plugins in
+// the order given.
+func (r *resolver) linkHighest(nodes pluginList) pluginList {
+	var linked = pluginList{}
+	for _, n := range nodes {
+		if !r.candidates[n.plugin.ID()].contains(n) {
+			continue
+		}
+		linked = append(linked, n)
+		for _, d := range n.plugin.Dependencies() {
+			if providers := r.providers(d); len(providers) > 0 {
+				dn := providers[0]
+				n.dependencies[d] = dn
+				dn.dependents = append(dn.dependents, n)
+			}
+		}
+	}
+	return linked
+}
+
+func (list pluginList) contains(n *LoadedPlugin) bool {
+	for _, ln := range list {
+		if ln == n {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns the plugins in the list that are not in other
+func (list pluginList) without(other pluginList) pluginList {
+	var remaining = pluginList{}
+	for _, n := range list {
+		if !other.contains(n) {
+			remaining = append(remaining, n)
+		}
+	}
+	return remaining
+}
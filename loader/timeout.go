@@ -0,0 +1,144 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+type (
+	// TimeoutError is returned if a RegisterFunc or UnregisterFunc did not return within the
+	// timeout of the plugin, see WithStartTimeout and WithStopTimeout
+	TimeoutError struct {
+		Plugin  plugin.Plugin
+		Timeout time.Duration
+		// Op is "register" or "unregister"
+		Op string
+	}
+
+	// detached has the values of a context returned by a RegisterFunc, but the deadline and
+	// cancellation of the context given to Load. The timeout of a plugin so does not carry
+	// over to its dependents.
+	detached struct {
+		context.Context
+		values context.Context
+	}
+)
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("Plugin [ %s %s ]: %s timed out after %s", e.Plugin.ID(), e.Plugin.Version(), e.Op, e.Timeout)
+}
+
+func (d detached) Value(key interface{}) interface{} {
+	return d.values.Value(key)
+}
+
+// Detached returns a context with the values of values, but the deadline and cancellation of
+// ctx, like the context a plugin's dependents are given when it was registered with a timeout
+func Detached(ctx context.Context, values context.Context) context.Context {
+	return detached{Context: ctx, values: values}
+}
+
+// WithStartTimeout limits how long the RegisterFunc of each plugin may take. A plugin that is
+// plugin.Timed with a StartTimeout uses its own instead. The RegisterFunc is given a context
+// with the deadline; if it has not returned by then, Load fails with a TimeoutError.
+func WithStartTimeout(timeout time.Duration) Option {
+	return func(o *loadOptions) {
+		o.startTimeout = timeout
+	}
+}
+
+// WithStopTimeout limits how long the UnregisterFunc of each plugin may take, when rolling
+// back and in Unload. A plugin that is plugin.Timed with a StopTimeout uses its own instead.
+func WithStopTimeout(timeout time.Duration) Option {
+	return func(o *loadOptions) {
+		o.stopTimeout = timeout
+	}
+}
+
+func (o loadOptions) timeouts(p plugin.Plugin) (start time.Duration, stop time.Duration) {
+	start, stop = o.startTimeout, o.stopTimeout
+	if t, ok := p.(plugin.Timed); ok {
+		if t.StartTimeout() > 0 {
+			start = t.StartTimeout()
+		}
+		if t.StopTimeout() > 0 {
+			stop = t.StopTimeout()
+		}
+	}
+	return start, stop
+}
+
+// register calls RegisterFunc for the plugin within the start timeout of the plugin, and
+// tells the observers
+func (state *LoadedPlugins) register(ctx context.Context, RegisterFunc RegisterFunc, n *LoadedPlugin) (context.Context, error) {
+	timeout, _ := state.options.timeouts(n.plugin)
+	observers := state.options.observers
+
+	observers.notify(func(o Observer) { o.Starting(n) })
+	start := time.Now()
+	ctx, err := callWithTimeout(ctx, timeout, "register", n, RegisterFunc)
+	elapsed := time.Since(start)
+	if err != nil {
+		observers.notify(func(o Observer) { o.Failed(n, err) })
+	} else {
+		observers.notify(func(o Observer) { o.Started(n, elapsed) })
+	}
+	return ctx, err
+}
+
+// unregister calls UnregisterFunc for the plugin within the stop timeout of the plugin, and
+// tells the observers
+func (state *LoadedPlugins) unregister(ctx context.Context, unRegisterFunc UnregisterFunc, n *LoadedPlugin) (context.Context, error) {
+	_, timeout := state.options.timeouts(n.plugin)
+	observers := state.options.observers
+
+	observers.notify(func(o Observer) { o.Stopping(n) })
+	start := time.Now()
+	ctx, err := callWithTimeout(ctx, timeout, "unregister", n, func(ctx context.Context, n *LoadedPlugin) (context.Context, error) {
+		return unRegisterFunc(ctx, n)
+	})
+	elapsed := time.Since(start)
+	observers.notify(func(o Observer) { o.Stopped(n, elapsed, err) })
+	return ctx, err
+}
+
+// callWithTimeout runs f, giving up with a TimeoutError after timeout, if more than 0.
+// If f does not return in time it is left running, it is expected to give up once the
+// context it was given is done.
+func callWithTimeout(ctx context.Context, timeout time.Duration, op string, n *LoadedPlugin,
+	f func(context.Context, *LoadedPlugin) (context.Context, error)) (context.Context, error) {
+
+	if timeout <= 0 {
+		return f(ctx, n)
+	}
+
+	timed, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		ctx context.Context
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resultCtx, err := f(timed, n)
+		done <- result{resultCtx, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.ctx == nil {
+			return nil, r.err
+		}
+		return Detached(ctx, r.ctx), r.err
+	case <-timed.Done():
+		if err := ctx.Err(); err != nil {
+			// Cancelled by the caller rather than timed out
+			return ctx, err
+		}
+		return ctx, TimeoutError{Plugin: n.plugin, Timeout: timeout, Op: op}
+	}
+}
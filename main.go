@@ -6,34 +6,68 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rovarghe/mule/internal"
 	"github.com/rovarghe/mule/internal/builtin"
 	"github.com/rovarghe/mule/schema"
 )
 
-type H struct {
-	context context.Context
-}
+const (
+	shutdownTimeout = 30 * time.Second
+	// defaultAdminAddr only listens locally, the admin endpoints can restart modules
+	defaultAdminAddr = "localhost:8001"
+
+	// Environment variables configuring the admin server. It is only started with a token.
+	adminAddrEnv  = "MULE_ADMIN_ADDR"
+	adminTokenEnv = "MULE_ADMIN_TOKEN"
+)
 
-func (h *H) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	internal.Process(h.context, r)
+// startServer serves the handler on addr. If required, the process exits if it cannot be
+// served, otherwise the failure is only logged.
+func startServer(addr string, handler http.Handler, required bool) *http.Server {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
 
-	/*
-		switch r.URL.Path {
-		case "/":
-			fmt.Println("RtmpOot served")
-		default:
-			http.DefaultServeMux.ServeHTTP(w, r)
+	go func() {
+		fmt.Println("Listening on", addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			if required {
+				log.Fatal(err)
+			}
+			log.Println("Not serving on", addr+",", err)
 		}
-	*/
+	}()
+
+	return server
 }
 
-func startServer(ctx context.Context) error {
-	fmt.Println("Listening on port", 8000)
-	return http.ListenAndServe(":8000", &H{
-		context: ctx,
-	})
+// startAdminServer serves the admin endpoints if a token is configured, see internal.AdminHandler
+func startAdminServer(ctx context.Context) *http.Server {
+	token := os.Getenv(adminTokenEnv)
+	if token == "" {
+		log.Println("Admin server disabled, set", adminTokenEnv, "to enable it")
+		return nil
+	}
+	addr := os.Getenv(adminAddrEnv)
+	if addr == "" {
+		addr = defaultAdminAddr
+	}
+	return startServer(addr, internal.NewAdminHandler(ctx, token), false)
+}
+
+// plan prints what loading the modules would do, for "mule plan"
+func plan(modules []schema.Module) int {
+	p, err := internal.PlanModules(modules)
+	fmt.Print(p)
+	if err != nil {
+		return 1
+	}
+	return 0
 }
 
 func main() {
@@ -41,11 +75,38 @@ func main() {
 		builtin.CoreModule,
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(plan(modules))
+	}
+
 	ctx, err := internal.LoadModules(context.Background(), modules)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	log.Fatal(startServer(ctx))
+	server := startServer(":8000", internal.NewHandler(ctx), true)
+	admin := startAdminServer(ctx)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	// Let requests in flight finish before stopping the modules serving them
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Server shutdown incomplete,", err)
+	}
+	if admin != nil {
+		if err := admin.Shutdown(shutdownCtx); err != nil {
+			log.Println("Admin server shutdown incomplete,", err)
+		}
+	}
+
+	if _, err := internal.UnloadModules(shutdownCtx); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capability is a named, versioned feature that a plugin provides, e.g. a session store.
+// A Dependency with Capability set is satisfied by any plugin providing it, so that
+// implementations can be swapped without editing the plugins that depend on them.
+// Capability names share the namespace of plugin IDs in dependencies, but are distinct from them.
+type Capability struct {
+	Name    ID
+	Version Version
+}
+
+// Provider is implemented by a Plugin that provides capabilities
+type Provider interface {
+	Provides() []Capability
+}
+
+// ProvidesOf returns the capabilities of a Plugin, nil if it is not a Provider
+func ProvidesOf(p Plugin) []Capability {
+	if pr, ok := p.(Provider); ok {
+		return pr.Provides()
+	}
+	return nil
+}
+
+// String representation of Capability, the name followed by the version, e.g. "session-store 1.2.0"
+func (c Capability) String() string {
+	return fmt.Sprintf("%s %s", c.Name, c.Version)
+}
+
+// ParseCapability converts a string to a Capability, the name followed by the version
+// Returns not-nil error if unable to parse.
+func ParseCapability(s string) (*Capability, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Invalid capability '%s', expecting a name and a version", s)
+	}
+	v, err := ParseVersion(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Capability{Name: ID(fields[0]), Version: *v}, nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (c Capability) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (c *Capability) UnmarshalText(text []byte) error {
+	parsed, err := ParseCapability(string(text))
+	if err != nil {
+		return err
+	}
+	*c = *parsed
+	return nil
+}
+
+// provides returns true if the plugin provides a version of the capability the dependency allows
+func provides(p Plugin, d Dependency) bool {
+	for _, c := range ProvidesOf(p) {
+		if c.Name == d.ID && d.Allows(c.Version) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Constraint is a set of acceptable versions.
+	// A Range is a Constraint, and so is a RangeSet for a union of several ranges.
+	Constraint interface {
+		Allows(v Version) bool
+		String() string
+	}
+
+	// RangeSet is a Constraint allowing the versions within any one of its ranges.
+	// It is used through a pointer, so that a Dependency holding one can still be used as a map key.
+	RangeSet struct {
+		Ranges []Range
+	}
+)
+
+// Allows returns true if Version falls within any of the ranges
+func (rs *RangeSet) Allows(v Version) bool {
+	for _, r := range rs.Ranges {
+		if v.IsWithin(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// String representation of RangeSet, the ranges separated by ||
+func (rs *RangeSet) String() string {
+	var strs = make([]string, len(rs.Ranges))
+	for i, r := range rs.Ranges {
+		strs[i] = r.String()
+	}
+	return strings.Join(strs, " || ")
+}
+
+// ParseConstraint converts a string to a Constraint. Besides ranges like [1.0.0,2.0.0) it accepts
+//
+//	^1.2.0            compatible versions, >=1.2.0 and below the next major version
+//	~1.2              >=1.2.0 and below the next minor version
+//	1.x, 1.2.*, 1     any version with the given major or minor version
+//	>=1.0.0 <2.0.0    comparators, all of which must be satisfied
+//	[1.0.0,)          ranges without a minimum or maximum
+//	[1.0,2.0) || ^3   a union of any of the above
+//
+// Upper bounds implied by ^, ~ and wildcards exclude the pre-releases of the bound itself,
+// ^1.2.0 does not allow 2.0.0-beta.
+// A single range is returned as a Range, a union as a *RangeSet.
+// Value of 'error' is nil if successful
+func ParseConstraint(s string) (Constraint, error) {
+	var ranges []Range
+
+	for _, alternative := range strings.Split(s, "||") {
+		alternative = strings.TrimSpace(alternative)
+		if alternative == "" {
+			return nil, fmt.Errorf("Empty alternative in constraint '%s'", s)
+		}
+
+		var r *Range
+		var err error
+		if alternative[0] == '[' || alternative[0] == '(' {
+			r, err = ParseRange(alternative)
+		} else {
+			r, err = parseComparators(alternative)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, *r)
+	}
+
+	if len(ranges) == 1 {
+		return ranges[0], nil
+	}
+	return &RangeSet{Ranges: ranges}, nil
+}
+
+// parseComparators reads space separated comparators and returns the range allowed by all of them
+func parseComparators(s string) (*Range, error) {
+	var r = Range{NoMinimum: true, NoMaximum: true}
+
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i++ {
+		comparator := fields[i]
+		// Allow a space between operator and version, e.g. ">= 1.0.0"
+		if strings.TrimLeft(comparator, "<>=^~") == "" && i+1 < len(fields) {
+			i++
+			comparator += fields[i]
+		}
+
+		cr, err := parseComparator(comparator)
+		if err != nil {
+			return nil, err
+		}
+		r = r.Intersect(*cr)
+	}
+
+	if r.IsEmpty() {
+		return nil, fmt.Errorf("Constraint '%s' does not allow any version", s)
+	}
+	return &r, nil
+}
+
+func parseComparator(s string) (*Range, error) {
+	var op string
+	for _, o := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, o) {
+			op = o
+			break
+		}
+	}
+
+	v, n, err := parsePartialVersion(s[len(op):])
+	if err != nil {
+		return nil, err
+	}
+
+	anyVersion := Range{NoMinimum: true, NoMaximum: true}
+	from := Range{Minimum: v, MinInclusive: true, NoMaximum: true}
+	if n == 0 {
+		// Wildcard, every operator that makes sense allows any version
+		switch op {
+		case ">", "<":
+			return nil, fmt.Errorf("Invalid comparator '%s'", s)
+		}
+		return &anyVersion, nil
+	}
+
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return &Range{Minimum: v, Maximum: v, MinInclusive: true, MaxInclusive: true}, nil
+		}
+		return below(from, nextVersion(v, n)), nil
+	case ">=":
+		return &from, nil
+	case ">":
+		if n == 3 {
+			return &Range{Minimum: v, NoMaximum: true}, nil
+		}
+		return &Range{Minimum: nextVersion(v, n), MinInclusive: true, NoMaximum: true}, nil
+	case "<":
+		if n < 3 {
+			v.Label = "0"
+		}
+		return &Range{Maximum: v, NoMinimum: true}, nil
+	case "<=":
+		if n == 3 {
+			return &Range{Maximum: v, MaxInclusive: true, NoMinimum: true}, nil
+		}
+		return &Range{Maximum: nextVersion(v, n), NoMinimum: true}, nil
+	case "^":
+		// The first non-zero component given may not change
+		switch {
+		case v.Major > 0 || n == 1:
+			return below(from, nextVersion(v, 1)), nil
+		case v.Minor > 0 || n == 2:
+			return below(from, nextVersion(v, 2)), nil
+		default:
+			return below(from, nextVersion(v, 3)), nil
+		}
+	default: // "~"
+		if n == 1 {
+			return below(from, nextVersion(v, 1)), nil
+		}
+		return below(from, nextVersion(v, 2)), nil
+	}
+}
+
+// below limits the range to versions below max
+func below(r Range, max Version) *Range {
+	r.Maximum = max
+	r.MaxInclusive = false
+	r.NoMaximum = false
+	return &r
+}
+
+// nextVersion increments the n-th component of the version, zeroing the ones after it.
+// The result has the lowest possible pre-release label, so that it is below every
+// pre-release of that version.
+func nextVersion(v Version, n int) Version {
+	switch n {
+	case 1:
+		return Version{Major: v.Major + 1, Label: "0"}
+	case 2:
+		return Version{Major: v.Major, Minor: v.Minor + 1, Label: "0"}
+	default:
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1, Label: "0"}
+	}
+}
+
+// parsePartialVersion parses versions that may have missing or wildcard components, like 1.2, 1.x or *.
+// Returns the version and the number of components given.
+func parsePartialVersion(s string) (Version, int, error) {
+	if strings.ContainsAny(s, "-+") {
+		// Pre-release and build metadata only make sense on a complete version
+		v, err := ParseSemver(s)
+		if err != nil {
+			return Version{}, 0, err
+		}
+		return *v, 3, nil
+	}
+
+	var v Version
+	if s == "" {
+		return v, 0, errors.New("Missing version in constraint")
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("Invalid version '%s'", s)
+	}
+
+	n := 0
+	components := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			continue
+		}
+		if n != i {
+			return v, 0, fmt.Errorf("Invalid version '%s', wildcards must come last", s)
+		}
+		j, err := strconv.Atoi(part)
+		if err != nil || j < 0 {
+			return v, 0, fmt.Errorf("Invalid version '%s'", s)
+		}
+		*components[i] = j
+		n++
+	}
+	return v, n, nil
+}
@@ -0,0 +1,93 @@
+package plugin_test
+
+import (
+	"testing"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+func TestParseConstraint(t *testing.T) {
+	var table = []struct {
+		s         string
+		canonical string
+		allowed   []string
+		denied    []string
+	}{
+		{"[1.0.0,2.0.0)", "[1.0.0,2.0.0)", []string{"1.0.0", "1.9.9", "2.0.0-beta"}, []string{"0.9.0", "2.0.0"}},
+		{"[1.0.0,)", "[1.0.0,)", []string{"1.0.0", "99.0.0"}, []string{"0.9.9", "1.0.0-rc.1"}},
+		{"(,2.0.0]", "(,2.0.0]", []string{"0.0.1", "2.0.0"}, []string{"2.0.1"}},
+		{"^1.2.0", "[1.2.0,2.0.0-0)", []string{"1.2.0", "1.9.0"}, []string{"1.1.9", "2.0.0-beta", "2.0.0"}},
+		{"^0.2.3", "[0.2.3,0.3.0-0)", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"^0.0.3", "[0.0.3,0.0.4-0)", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"^1.2.3-beta.2", "[1.2.3-beta.2,2.0.0-0)", []string{"1.2.3-beta.3", "1.2.3"}, []string{"1.2.3-beta.1"}},
+		{"~1.2", "[1.2.0,1.3.0-0)", []string{"1.2.0", "1.2.9"}, []string{"1.3.0", "1.1.0"}},
+		{"~1.2.3", "[1.2.3,1.3.0-0)", []string{"1.2.3", "1.2.4"}, []string{"1.2.2", "1.3.0"}},
+		{"~1", "[1.0.0,2.0.0-0)", []string{"1.5.0"}, []string{"2.0.0"}},
+		{"1.x", "[1.0.0,2.0.0-0)", []string{"1.0.0", "1.99.0"}, []string{"2.0.0", "0.9.0"}},
+		{"1.2.*", "[1.2.0,1.3.0-0)", []string{"1.2.7"}, []string{"1.3.0"}},
+		{"1", "[1.0.0,2.0.0-0)", []string{"1.2.3"}, []string{"2.0.0"}},
+		{"*", "(,)", []string{"0.0.0", "5.0.0-alpha"}, []string{}},
+		{"1.2.3", "[1.2.3,1.2.3]", []string{"1.2.3", "1.2.3+build"}, []string{"1.2.4"}},
+		{">=1.0.0 <2.0.0", "[1.0.0,2.0.0)", []string{"1.0.0", "1.5.0"}, []string{"2.0.0", "0.1.0"}},
+		{">= 1.0.0 < 2.0.0", "[1.0.0,2.0.0)", []string{"1.0.0"}, []string{"2.0.0"}},
+		{">1.0.0 <=2.0.0", "(1.0.0,2.0.0]", []string{"1.0.1", "2.0.0"}, []string{"1.0.0", "2.0.1"}},
+		{">1.2", "[1.3.0-0,)", []string{"1.3.0"}, []string{"1.2.9"}},
+		{"<=1.2", "(,1.3.0-0)", []string{"1.2.9"}, []string{"1.3.0"}},
+		{"<1.2", "(,1.2.0-0)", []string{"1.1.9"}, []string{"1.2.0-beta", "1.2.0"}},
+		{"[1.0,2.0) || [3.0,4.0)", "[1.0.0,2.0.0) || [3.0.0,4.0.0)", []string{"1.0.0", "3.5.0"}, []string{"2.5.0", "4.0.0"}},
+		{"^1.2 || >=3.0.0", "[1.2.0,2.0.0-0) || [3.0.0,)", []string{"1.2.0", "7.0.0"}, []string{"2.5.0"}},
+	}
+
+	for _, r := range table {
+		c, err := plugin.ParseConstraint(r.s)
+		if err != nil {
+			t.Error("Failed for", r.s, err)
+			continue
+		}
+		if c.String() != r.canonical {
+			t.Error("String representation error for", r.s, "expecting", r.canonical, "got", c.String())
+		}
+		for _, s := range r.allowed {
+			if v, _ := plugin.ParseSemver(s); !c.Allows(*v) {
+				t.Error(r.s, "should allow", s)
+			}
+		}
+		for _, s := range r.denied {
+			if v, _ := plugin.ParseSemver(s); c.Allows(*v) {
+				t.Error(r.s, "should not allow", s)
+			}
+		}
+	}
+
+	for _, s := range []string{"", "||", "^", ">=1.0.0 <1.0.0", "1.x.2", "1.2.3.4", ">*", "[1.0.0", "abc", "^1.0.0 ||"} {
+		if c, err := plugin.ParseConstraint(s); err == nil {
+			t.Error("Expecting error for", s, "got", c)
+		}
+	}
+}
+
+func TestDependencyConstraint(t *testing.T) {
+	d, err := plugin.ParseDependency("maven ^1.0.0 || ^2.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Constraint.(*plugin.RangeSet); !ok || d.ID != "maven" {
+		t.Fatal("Expecting a RangeSet constraint for maven, got", d)
+	}
+	if d.String() != "maven [1.0.0,2.0.0-0) || [2.0.0,3.0.0-0)" {
+		t.Error("Unexpected string representation", d.String())
+	}
+
+	maven := plugin.NewPlugin("maven", plugin.Version{Major: 2, Minor: 1}, []plugin.Dependency{})
+	if !plugin.Satisfies(maven, *d) {
+		t.Error("maven 2.1.0 should satisfy", d.String())
+	}
+
+	d, err = plugin.ParseDependency("maven~1.2")
+	if err != nil || d.Constraint != nil || d.Range.String() != "[1.2.0,1.3.0-0)" {
+		t.Error("Single ranges should be kept in Range, got", d, err)
+	}
+
+	// Dependencies with constraints must still be usable as map keys
+	_ = map[plugin.Dependency]bool{*d: true}
+}
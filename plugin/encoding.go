@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"encoding/json"
+)
+
+// Version, Range and Dependency are encoded as their string representations, so that they
+// read naturally in JSON, YAML and TOML documents and can be used as map keys.
+// Plugins are encoded as a Descriptor.
+
+// Descriptor is the serializable form of a Plugin
+type Descriptor struct {
+	ID           ID           `json:"id" yaml:"id" toml:"id"`
+	Version      Version      `json:"version" yaml:"version" toml:"version"`
+	Dependencies []Dependency `json:"dependencies,omitempty" yaml:"dependencies,omitempty" toml:"dependencies,omitempty"`
+}
+
+// Describe returns the Descriptor of a Plugin
+func Describe(p Plugin) Descriptor {
+	return Descriptor{
+		ID:           p.ID(),
+		Version:      p.Version(),
+		Dependencies: p.Dependencies(),
+	}
+}
+
+// Plugin creates a Plugin from the Descriptor
+func (d Descriptor) Plugin() Plugin {
+	dependencies := d.Dependencies
+	if dependencies == nil {
+		dependencies = []Dependency{}
+	}
+	return NewPlugin(d.ID, d.Version, dependencies)
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (v Version) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting whatever ParseVersion does
+func (v *Version) UnmarshalText(text []byte) error {
+	parsed, err := ParseVersion(string(text))
+	if err != nil {
+		return err
+	}
+	*v = *parsed
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (r Range) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (r *Range) UnmarshalText(text []byte) error {
+	parsed, err := ParseRange(string(text))
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Dependency) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting whatever ParseDependency does
+func (d *Dependency) UnmarshalText(text []byte) error {
+	parsed, err := ParseDependency(string(text))
+	if err != nil {
+		return err
+	}
+	*d = *parsed
+	return nil
+}
+
+// MarshalJSON encodes the plugin as a Descriptor
+func (p DefaultPlugin) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Describe(p))
+}
+
+// UnmarshalJSON decodes a Descriptor into the plugin
+func (p *DefaultPlugin) UnmarshalJSON(data []byte) error {
+	var d Descriptor
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	*p = d.Plugin().(DefaultPlugin)
+	return nil
+}
+
+// MarshalYAML encodes the plugin as a Descriptor, for YAML libraries that support it
+func (p DefaultPlugin) MarshalYAML() (interface{}, error) {
+	return Describe(p), nil
+}
+
+// UnmarshalYAML decodes a Descriptor into the plugin, for YAML libraries that support it
+func (p *DefaultPlugin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var d Descriptor
+	if err := unmarshal(&d); err != nil {
+		return err
+	}
+	*p = d.Plugin().(DefaultPlugin)
+	return nil
+}
@@ -0,0 +1,106 @@
+package plugin_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+func mustDependency(t *testing.T, s string) plugin.Dependency {
+	d, err := plugin.ParseDependency(s)
+	if err != nil {
+		t.Fatal(s, err)
+	}
+	return *d
+}
+
+func TestVersionRangeText(t *testing.T) {
+	for _, s := range []string{"1.2.3", "1.0.0-beta.2+exp.sha", "0.1.0+build"} {
+		var v plugin.Version
+		if err := v.UnmarshalText([]byte(s)); err != nil {
+			t.Fatal(s, err)
+		}
+		if text, _ := v.MarshalText(); string(text) != s {
+			t.Error("Expected", s, "got", string(text))
+		}
+	}
+
+	for _, s := range []string{"[1.0.0,2.0.0)", "(1.0.0,1.2.0-0]", "[1.0.0,)", "(,2.0.0]"} {
+		var r plugin.Range
+		if err := r.UnmarshalText([]byte(s)); err != nil {
+			t.Fatal(s, err)
+		}
+		if text, _ := r.MarshalText(); string(text) != s {
+			t.Error("Expected", s, "got", string(text))
+		}
+	}
+
+	var v plugin.Version
+	if err := v.UnmarshalText([]byte("not.a.version")); err == nil {
+		t.Error("Expected error for invalid version")
+	}
+}
+
+func TestDependencyJSON(t *testing.T) {
+	var deps = []plugin.Dependency{
+		mustDependency(t, "core [1.0.0,2.0.0)"),
+		mustDependency(t, "web ^1.2 || ^2"),
+	}
+
+	data, err := json.Marshal(deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `["core [1.0.0,2.0.0)","web [1.2.0,2.0.0-0) || [2.0.0,3.0.0-0)"]` {
+		t.Error("Unexpected encoding", string(data))
+	}
+
+	var decoded []plugin.Dependency
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range decoded {
+		if d.String() != deps[i].String() {
+			t.Error("Expected", deps[i].String(), "got", d.String())
+		}
+	}
+
+	// Usable as map keys, as in lockfiles
+	data, err = json.Marshal(map[plugin.Dependency]plugin.Version{deps[0]: {Major: 1, Minor: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"core [1.0.0,2.0.0)":"1.4.0"}` {
+		t.Error("Unexpected encoding", string(data))
+	}
+}
+
+func TestPluginJSON(t *testing.T) {
+	p := plugin.NewPlugin("web", plugin.Version{Major: 1, Minor: 2, Label: "rc.1"},
+		[]plugin.Dependency{mustDependency(t, "core [1.0.0,2.0.0)")})
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"id":"web","version":"1.2.0-rc.1","dependencies":["core [1.0.0,2.0.0)"]}` {
+		t.Error("Unexpected encoding", string(data))
+	}
+
+	var decoded plugin.DefaultPlugin
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !plugin.PluginEquals(p, decoded) {
+		t.Error("Expected", p, "got", decoded)
+	}
+
+	var bare plugin.DefaultPlugin
+	if err := json.Unmarshal([]byte(`{"id":"core","version":"1.0.0"}`), &bare); err != nil {
+		t.Fatal(err)
+	}
+	if !plugin.PluginEquals(bare, plugin.NewPlugin("core", plugin.Version{Major: 1}, []plugin.Dependency{})) {
+		t.Error("Unexpected plugin", bare)
+	}
+}
@@ -0,0 +1,272 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestName is the base name of a manifest file within a module directory, e.g. mule.json.
+// Other formats such as mule.yaml can be read once their decoder is registered, see
+// RegisterManifestFormat.
+const ManifestName = "mule"
+
+type (
+	// Manifest declares a plugin in a file, so that its metadata can be read and changed
+	// without reading Go source. Dependencies are written as strings accepted by ParseDependency.
+	//
+	//	{
+	//	  "id": "about",
+	//	  "version": "1.0.0",
+	//	  "description": "Serves /about",
+	//	  "provider": "github.com/rovarghe/mule",
+	//	  "dependencies": ["mule ^1.0"],
+	//	  "optional": ["metrics ^2"],
+	//	  "conflicts": ["legacy-about *"],
+	//	  "replaces": ["about-v0 *"],
+	//	  "provides": ["info-page 1.0.0"],
+	//	  "startTimeout": "30s",
+	//	  "stopTimeout": "5s"
+	//	}
+	Manifest struct {
+		ID           ID           `json:"id" yaml:"id" toml:"id"`
+		Version      Version      `json:"version" yaml:"version" toml:"version"`
+		Description  string       `json:"description,omitempty" yaml:"description,omitempty" toml:"description,omitempty"`
+		Provider     string       `json:"provider,omitempty" yaml:"provider,omitempty" toml:"provider,omitempty"`
+		Dependencies []Dependency `json:"dependencies,omitempty" yaml:"dependencies,omitempty" toml:"dependencies,omitempty"`
+		// Optional plugins are used if present but not required, they need not be marked optional
+		Optional []Dependency `json:"optional,omitempty" yaml:"optional,omitempty" toml:"optional,omitempty"`
+		// Conflicts are plugins that cannot be loaded together with this one
+		Conflicts []Dependency `json:"conflicts,omitempty" yaml:"conflicts,omitempty" toml:"conflicts,omitempty"`
+		// Replaces are plugins this one takes the place of
+		Replaces []Dependency `json:"replaces,omitempty" yaml:"replaces,omitempty" toml:"replaces,omitempty"`
+		// Provides are the capabilities of the plugin, written as a name and a version
+		Provides []Capability `json:"provides,omitempty" yaml:"provides,omitempty" toml:"provides,omitempty"`
+		// StartTimeout and StopTimeout limit how long the plugin may take to start and stop
+		StartTimeout Duration `json:"startTimeout,omitempty" yaml:"startTimeout,omitempty" toml:"startTimeout,omitempty"`
+		StopTimeout  Duration `json:"stopTimeout,omitempty" yaml:"stopTimeout,omitempty" toml:"stopTimeout,omitempty"`
+	}
+
+	// Duration is a time.Duration written like "1m30s", see time.ParseDuration
+	Duration time.Duration
+
+	// ManifestPlugin is a Plugin built from a Manifest. It is a Conflicter, a Replacer, a Provider and Timed.
+	ManifestPlugin struct {
+		DefaultPlugin
+		manifest Manifest
+	}
+
+	// UnmarshalFunc decodes a document into v, like json.Unmarshal
+	UnmarshalFunc func(data []byte, v interface{}) error
+)
+
+// manifestFormats maps file extensions to decoders.
+// Only JSON is built in, to keep the package free of third party dependencies. There is no
+// YAML decoder, callers that want mule.yaml must register one with RegisterManifestFormat.
+var manifestFormats = map[string]UnmarshalFunc{
+	".json": unmarshalStrictJSON,
+}
+
+// RegisterManifestFormat adds a decoder for manifests with the given file extension. Only JSON
+// is built in, YAML manifests need a YAML library to be registered, e.g.
+//
+//	plugin.RegisterManifestFormat(".yaml", yaml.Unmarshal)
+//	plugin.RegisterManifestFormat(".yml", yaml.Unmarshal)
+//
+// The decoder is given a *Manifest. It must use encoding.TextUnmarshaler for the versions,
+// dependencies, capabilities and timeouts written as strings, as gopkg.in/yaml.v3 does.
+// Returns the decoder it replaces, nil if there was none. A nil unmarshal removes the format.
+// It is not safe to call concurrently with LoadManifest, register formats from an init function.
+func RegisterManifestFormat(ext string, unmarshal UnmarshalFunc) UnmarshalFunc {
+	ext = strings.ToLower(ext)
+	previous := manifestFormats[ext]
+	if unmarshal == nil {
+		delete(manifestFormats, ext)
+	} else {
+		manifestFormats[ext] = unmarshal
+	}
+	return previous
+}
+
+// unmarshalStrictJSON rejects unknown fields, so that a misspelled key is not silently ignored
+func unmarshalStrictJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// LoadManifest reads a manifest and builds a Plugin from it. The path is either a manifest file,
+// or a directory holding a file named ManifestName with one of the registered extensions.
+// The id and version are required. The returned Plugin is a ManifestPlugin.
+//
+// Only mule.json can be read out of the box. This package ships no YAML decoder, mule.yaml
+// is only read once the caller registers one with RegisterManifestFormat, see there.
+// Value of 'error' is nil if successful
+func LoadManifest(path string) (Plugin, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if path, err = findManifest(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	unmarshal, ok := manifestFormats[ext]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported manifest format '%s', register a decoder for '%s' with plugin.RegisterManifestFormat", path, ext)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Invalid manifest '%s': %v", path, err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid manifest '%s': %v", path, err)
+	}
+	return m.Plugin(), nil
+}
+
+// findManifest looks for the one manifest in dir
+func findManifest(dir string) (string, error) {
+	var found []string
+	for ext := range manifestFormats {
+		path := filepath.Join(dir, ManifestName+ext)
+		if _, err := os.Stat(path); err == nil {
+			found = append(found, path)
+		}
+	}
+	sort.Strings(found)
+	switch len(found) {
+	case 0:
+		// A manifest in a format without a decoder is more likely than a missing one
+		if others, _ := filepath.Glob(filepath.Join(dir, ManifestName+".*")); len(others) > 0 {
+			return "", fmt.Errorf("No %s manifest in '%s' in a registered format, register a decoder for %v with plugin.RegisterManifestFormat",
+				ManifestName, dir, others)
+		}
+		return "", fmt.Errorf("No %s manifest in '%s'", ManifestName, dir)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("More than one %s manifest in '%s': %v", ManifestName, dir, found)
+	}
+}
+
+func (m Manifest) validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("Missing id")
+	}
+	// A missing version decodes as 0.0.0, which no released plugin has
+	if m.Version == (Version{}) {
+		return fmt.Errorf("Missing version")
+	}
+	for _, list := range [][]Dependency{m.Dependencies, m.Optional, m.Conflicts, m.Replaces} {
+		for _, d := range list {
+			if d.ID == m.ID {
+				return fmt.Errorf("Plugin '%s' refers to itself", m.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// Plugin builds the Plugin declared by the manifest. Its dependencies include
+// the Optional ones, marked optional.
+func (m Manifest) Plugin() Plugin {
+	dependencies := append([]Dependency{}, m.Dependencies...)
+	for _, d := range m.Optional {
+		d.Optional = true
+		dependencies = append(dependencies, d)
+	}
+	return ManifestPlugin{
+		DefaultPlugin: DefaultPlugin{m.ID, m.Version, dependencies},
+		manifest:      m,
+	}
+}
+
+// Manifest returns the manifest the plugin was built from
+func (p ManifestPlugin) Manifest() Manifest {
+	return p.manifest
+}
+
+// Conflicts returns the conflicts declared by the manifest
+func (p ManifestPlugin) Conflicts() []Dependency {
+	return p.manifest.Conflicts
+}
+
+// Replaces returns the replacements declared by the manifest
+func (p ManifestPlugin) Replaces() []Dependency {
+	return p.manifest.Replaces
+}
+
+// Provides returns the capabilities declared by the manifest
+func (p ManifestPlugin) Provides() []Capability {
+	return p.manifest.Provides
+}
+
+// StartTimeout returns the start timeout declared by the manifest
+func (p ManifestPlugin) StartTimeout() time.Duration {
+	return time.Duration(p.manifest.StartTimeout)
+}
+
+// StopTimeout returns the stop timeout declared by the manifest
+func (p ManifestPlugin) StopTimeout() time.Duration {
+	return time.Duration(p.manifest.StopTimeout)
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON encodes the plugin as its Manifest
+func (p ManifestPlugin) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.manifest)
+}
+
+// MarshalYAML encodes the plugin as its Manifest, for YAML libraries that support it
+func (p ManifestPlugin) MarshalYAML() (interface{}, error) {
+	return p.manifest, nil
+}
+
+// UnmarshalJSON decodes a Manifest into the plugin
+func (p *ManifestPlugin) UnmarshalJSON(data []byte) error {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*p = m.Plugin().(ManifestPlugin)
+	return nil
+}
+
+// UnmarshalYAML decodes a Manifest into the plugin, for YAML libraries that support it
+func (p *ManifestPlugin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var m Manifest
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	*p = m.Plugin().(ManifestPlugin)
+	return nil
+}
@@ -0,0 +1,205 @@
+package plugin_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "mule.json", `{
+		"id": "about",
+		"version": "1.2.0",
+		"description": "Serves /about",
+		"provider": "github.com/rovarghe/mule",
+		"dependencies": ["mule ^1.0"],
+		"optional": ["metrics [2.0.0,3.0.0)"],
+		"conflicts": ["legacy-about *"],
+		"startTimeout": "1m30s"
+	}`)
+
+	p, err := plugin.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := plugin.NewPlugin("about", plugin.Version{Major: 1, Minor: 2},
+		[]plugin.Dependency{mustDependency(t, "mule ^1.0"), mustDependency(t, "metrics [2.0.0,3.0.0) optional")})
+	if !plugin.PluginEquals(p, expected) {
+		t.Error("Expected", expected, "got", p)
+	}
+
+	m := p.(plugin.ManifestPlugin).Manifest()
+	if m.Description != "Serves /about" || m.Provider != "github.com/rovarghe/mule" {
+		t.Error("Unexpected manifest", m)
+	}
+	if len(m.Optional) != 1 || m.Optional[0].String() != "metrics [2.0.0,3.0.0)" {
+		t.Error("Unexpected optional dependencies", m.Optional)
+	}
+	if len(m.Conflicts) != 1 || m.Conflicts[0].ID != "legacy-about" {
+		t.Error("Unexpected conflicts", m.Conflicts)
+	}
+	timed := p.(plugin.Timed)
+	if timed.StartTimeout() != 90*time.Second || timed.StopTimeout() != 0 {
+		t.Error("Unexpected timeouts", timed.StartTimeout(), timed.StopTimeout())
+	}
+
+	// Encodes back to the manifest
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded plugin.ManifestPlugin
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !plugin.PluginEquals(p, decoded) || decoded.Manifest().Provider != m.Provider {
+		t.Error("Expected", p, "got", decoded)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+	var table = []struct {
+		name    string
+		content string
+	}{
+		{"missing-id.json", `{"version": "1.0.0"}`},
+		{"bad-version.json", `{"id": "a", "version": "one"}`},
+		{"no-version.json", `{"id": "a"}`},
+		{"bad-dependency.json", `{"id": "a", "version": "1.0.0", "dependencies": ["b [2.0.0,1.0.0"]}`},
+		{"unknown-field.json", `{"id": "a", "version": "1.0.0", "dependncies": ["b ^1"]}`},
+		{"bad-timeout.json", `{"id": "a", "version": "1.0.0", "stopTimeout": "5"}`},
+		{"self.json", `{"id": "a", "version": "1.0.0", "dependencies": ["a ^1"]}`},
+		{"mule.toml", `id = "a"`},
+	}
+
+	for _, r := range table {
+		if _, err := plugin.LoadManifest(writeFile(t, dir, r.name, r.content)); err == nil {
+			t.Error("Expected error for", r.name)
+		}
+	}
+
+	if _, err := plugin.LoadManifest(t.TempDir()); err == nil {
+		t.Error("Expected error for directory without manifest")
+	}
+}
+
+// unmarshalYAML is enough of a YAML decoder for the tests: a mapping of scalars and lists
+// of scalars, decoded through JSON
+func unmarshalYAML(data []byte, v interface{}) error {
+	var doc = map[string]interface{}{}
+	var list string
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(trimmed, "- "):
+			doc[list] = append(doc[list].([]string), strings.Trim(strings.TrimPrefix(trimmed, "- "), `"`))
+		default:
+			kv := strings.SplitN(trimmed, ":", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("Invalid line '%s'", line)
+			}
+			key, value := kv[0], strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			if value == "" {
+				list = key
+				doc[key] = []string{}
+			} else {
+				doc[key] = value
+			}
+		}
+	}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
+func TestLoadManifestYAML(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "mule.yaml", `
+id: about
+version: 1.0.0
+description: Serves /about
+dependencies:
+  - "mule ^1.0"
+optional:
+  - metrics ^2
+stopTimeout: 5s
+`)
+
+	// Without a decoder, the error says how to get one
+	_, err := plugin.LoadManifest(dir)
+	if err == nil || !strings.Contains(err.Error(), "RegisterManifestFormat") {
+		t.Error("Expecting an error pointing at RegisterManifestFormat, got", err)
+	}
+	_, err = plugin.LoadManifest(filepath.Join(dir, "mule.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "RegisterManifestFormat") {
+		t.Error("Expecting an error pointing at RegisterManifestFormat, got", err)
+	}
+
+	previous := plugin.RegisterManifestFormat(".yaml", unmarshalYAML)
+	t.Cleanup(func() { plugin.RegisterManifestFormat(".yaml", previous) })
+
+	p, err := plugin.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := p.(plugin.ManifestPlugin).Manifest()
+	if p.ID() != "about" || p.Version().String() != "1.0.0" || m.Description != "Serves /about" {
+		t.Error("Unexpected plugin", p)
+	}
+	if len(p.Dependencies()) != 2 || p.Dependencies()[0].ID != "mule" || !p.Dependencies()[1].Optional {
+		t.Error("Unexpected dependencies", p.Dependencies())
+	}
+	if p.(plugin.Timed).StopTimeout() != 5*time.Second {
+		t.Error("Unexpected stop timeout", p.(plugin.Timed).StopTimeout())
+	}
+}
+
+func TestRegisterManifestFormat(t *testing.T) {
+	// A stand-in for a YAML decoder
+	previous := plugin.RegisterManifestFormat(".yaml", func(data []byte, v interface{}) error {
+		m := v.(*plugin.Manifest)
+		m.ID = plugin.ID(data)
+		return m.Version.UnmarshalText([]byte("2.0.0"))
+	})
+	t.Cleanup(func() { plugin.RegisterManifestFormat(".yaml", previous) })
+
+	dir := t.TempDir()
+	writeFile(t, dir, "mule.yaml", "web")
+	p, err := plugin.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID() != "web" || p.Version().String() != "2.0.0" {
+		t.Error("Unexpected plugin", p)
+	}
+
+	writeFile(t, dir, "mule.json", `{"id": "web", "version": "2.0.0"}`)
+	if _, err := plugin.LoadManifest(dir); err == nil {
+		t.Error("Expected error for directory with two manifests")
+	}
+
+	// Removing the format
+	plugin.RegisterManifestFormat(".yaml", nil)
+	if _, err := plugin.LoadManifest(filepath.Join(dir, "mule.yaml")); err == nil {
+		t.Error("Expected error for a format that was removed")
+	}
+}
@@ -11,16 +11,48 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 // Dependency is a link from one plugin to another
+// The acceptable versions are given by Range, or by Constraint if it is not nil.
+// An Optional dependency is used if a plugin satisfying it is present, but is not required.
+// If Capability is set, ID is the name of a Capability rather than of a plugin.
 type Dependency struct {
-	ID    ID
-	Range Range
+	ID         ID
+	Range      Range
+	Constraint Constraint
+	Optional   bool
+	Capability bool
 }
 
+// Suffixes marking a dependency as optional or on a capability in its string representation
+const (
+	optionalSuffix   = " optional"
+	capabilitySuffix = " capability"
+)
+
 func (d Dependency) String() string {
-	return fmt.Sprintf("%s %s", d.ID, d.Range.String())
+	str := fmt.Sprintf("%s %s", d.ID, d.constraint().String())
+	if d.Capability {
+		str += capabilitySuffix
+	}
+	if d.Optional {
+		str += optionalSuffix
+	}
+	return str
+}
+
+// Allows returns true if the version is acceptable for the dependency
+func (d Dependency) Allows(v Version) bool {
+	return d.constraint().Allows(v)
+}
+
+func (d Dependency) constraint() Constraint {
+	if d.Constraint != nil {
+		return d.Constraint
+	}
+	return d.Range
 }
 
 // ID is a unique ID for the plugin.
@@ -40,6 +72,42 @@ type Plugin interface {
 	//Payload      interface{}
 }
 
+// Conflicter is implemented by a Plugin that cannot be loaded together with the
+// versions of other plugins allowed by its conflicts
+type Conflicter interface {
+	Conflicts() []Dependency
+}
+
+// Replacer is implemented by a Plugin that takes the place of the versions of other plugins
+// allowed by its replacements. A dependency on a replaced plugin can be satisfied by the
+// replacement, and the replaced versions are not loaded alongside it.
+type Replacer interface {
+	Replaces() []Dependency
+}
+
+// Timed is implemented by a Plugin that limits how long it may take to start and stop.
+// A timeout of 0 leaves the choice to the loader.
+type Timed interface {
+	StartTimeout() time.Duration
+	StopTimeout() time.Duration
+}
+
+// ConflictsOf returns the conflicts of a Plugin, nil if it is not a Conflicter
+func ConflictsOf(p Plugin) []Dependency {
+	if c, ok := p.(Conflicter); ok {
+		return c.Conflicts()
+	}
+	return nil
+}
+
+// ReplacesOf returns the plugins a Plugin replaces, nil if it is not a Replacer
+func ReplacesOf(p Plugin) []Dependency {
+	if r, ok := p.(Replacer); ok {
+		return r.Replaces()
+	}
+	return nil
+}
+
 type DefaultPlugin struct {
 	id           ID
 	version      Version
@@ -63,9 +131,12 @@ func NewPlugin(id ID, version Version, dependencies []Dependency) Plugin {
 }
 
 // Satisfies returns true if a Plugin has the same ID and falls within the Range
-// of a Dependency
+// of a Dependency, or for a dependency on a capability, provides an acceptable version of it
 func Satisfies(p Plugin, d Dependency) bool {
-	return p.ID() == d.ID && p.Version().IsWithin(d.Range)
+	if d.Capability {
+		return provides(p, d)
+	}
+	return p.ID() == d.ID && d.Allows(p.Version())
 }
 
 func PluginEquals(f Plugin, s Plugin) bool {
@@ -74,22 +145,35 @@ func PluginEquals(f Plugin, s Plugin) bool {
 		reflect.DeepEqual(f.Dependencies(), s.Dependencies())
 }
 
-// ParseDependency converts a string to a Dependency type
+// ParseDependency converts a string to a Dependency type, an ID followed by a constraint
+// as accepted by ParseConstraint, e.g. "foo [1.0.0,2.0.0)" or "foo ^1.2".
+// A trailing "capability" makes it a dependency on a capability, and a trailing "optional"
+// an optional dependency, e.g. "session-store ^1.2 capability optional"
 // Returns not-nil error if unable to parse.
 func ParseDependency(s string) (*Dependency, error) {
-	i := strings.IndexAny(s, " [(")
+	s = strings.TrimRight(s, " ")
+	optional := strings.HasSuffix(s, optionalSuffix)
+	s = strings.TrimSuffix(s, optionalSuffix)
+	capability := strings.HasSuffix(s, capabilitySuffix)
+	s = strings.TrimSuffix(s, capabilitySuffix)
+
+	i := strings.IndexAny(s, " [(^~<>=")
 	if i < 0 {
 		return nil, errors.New("No version range")
 	}
 	id := s[:i]
 	s = s[i:]
-	r, err := ParseRange(strings.TrimLeft(s, " "))
+	c, err := ParseConstraint(strings.TrimLeft(s, " "))
 	if err != nil {
 		return nil, err
 	}
-	return &Dependency{
-		ID:    ID(id),
-		Range: *r,
-	}, nil
+
+	d := &Dependency{ID: ID(id), Optional: optional, Capability: capability}
+	if r, ok := c.(Range); ok {
+		d.Range = r
+	} else {
+		d.Constraint = c
+	}
+	return d, nil
 
 }
@@ -15,34 +15,45 @@ func TestParseDependency(t *testing.T) {
 	}{
 		{
 			plugin.Dependency{
-				plugin.ID("foo"),
-				plugin.Range{
-					Minimum:      plugin.Version{1, 0, 0, ""},
+				ID: plugin.ID("foo"),
+				Range: plugin.Range{
+					Minimum:      plugin.Version{Major: 1, Minor: 0, Patch: 0},
 					MinInclusive: true,
-					Maximum:      plugin.Version{2, 0, 0, ""},
+					Maximum:      plugin.Version{Major: 2, Minor: 0, Patch: 0},
 					MaxInclusive: true,
 				},
 			}, "foo [1.0.0,2.0.0]"}, // one space
 		{
 			plugin.Dependency{
-				plugin.ID("foo"),
-				plugin.Range{
-					Minimum:      plugin.Version{1, 0, 0, ""},
+				ID: plugin.ID("foo"),
+				Range: plugin.Range{
+					Minimum:      plugin.Version{Major: 1, Minor: 0, Patch: 0},
 					MinInclusive: false,
-					Maximum:      plugin.Version{2, 0, 0, ""},
+					Maximum:      plugin.Version{Major: 2, Minor: 0, Patch: 0},
 					MaxInclusive: true,
 				},
 			}, "foo(1.0.0,2.0.0]"}, // no space
 		{
 			plugin.Dependency{
-				plugin.ID("foo"),
-				plugin.Range{
-					Minimum:      plugin.Version{1, 0, 0, ""},
+				ID: plugin.ID("foo"),
+				Range: plugin.Range{
+					Minimum:      plugin.Version{Major: 1, Minor: 0, Patch: 0},
 					MinInclusive: false,
-					Maximum:      plugin.Version{2, 0, 0, ""},
+					Maximum:      plugin.Version{Major: 2, Minor: 0, Patch: 0},
 					MaxInclusive: false,
 				},
 			}, "foo (1.0.0,2.0.0)"},
+		{
+			plugin.Dependency{
+				ID: plugin.ID("foo"),
+				Range: plugin.Range{
+					Minimum:      plugin.Version{Major: 1, Minor: 0, Patch: 0},
+					MinInclusive: true,
+					Maximum:      plugin.Version{Major: 2, Minor: 0, Patch: 0},
+					MaxInclusive: false,
+				},
+				Optional: true,
+			}, "foo [1.0.0,2.0.0) optional"},
 	}
 
 	for _, r := range table {
@@ -116,3 +127,36 @@ func TestPluginSatisfiesDependency(t *testing.T) {
 	}
 
 }
+
+func TestCapabilityDependency(t *testing.T) {
+	d, err := plugin.ParseDependency("session-store ^1.2 capability optional")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Capability || !d.Optional || d.ID != "session-store" {
+		t.Error("Unexpected dependency", *d)
+	}
+	if d.String() != "session-store [1.2.0,2.0.0-0) capability optional" {
+		t.Error("Unexpected string", d.String())
+	}
+
+	c, err := plugin.ParseCapability("session-store 1.4.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis := plugin.Manifest{ID: "session-redis", Version: plugin.Version{Major: 3}, Provides: []plugin.Capability{*c}}.Plugin()
+	if !plugin.Satisfies(redis, *d) {
+		t.Error("Expecting", redis, "to satisfy", d)
+	}
+	c.Version = plugin.Version{Major: 2}
+	if plugin.Satisfies(plugin.Manifest{ID: "session-redis", Provides: []plugin.Capability{*c}}.Plugin(), *d) {
+		t.Error("Expecting session-store 2.0.0 not to satisfy", d)
+	}
+	if plugin.Satisfies(plugin.NewPlugin("session-store", plugin.Version{Major: 1, Minor: 5}, nil), *d) {
+		t.Error("Expecting a plugin with the capability's name not to satisfy", d)
+	}
+
+	if _, err := plugin.ParseCapability("session-store"); err == nil {
+		t.Error("Expecting error for a capability without version")
+	}
+}
@@ -0,0 +1,140 @@
+package plugin
+
+// Ranges are compared by their bounds. An exclusive minimum is first turned into the
+// inclusive minimum of the version right after it, so that (1.0.0,2.0.0) and [1.0.1-0,2.0.0)
+// are seen as the same set of versions.
+
+// successor returns the lowest version above v. Build metadata is not part of the order
+// so it is dropped. After a release the next version is the lowest pre-release of the next
+// patch, after a pre-release it is the same label with a lowest numeric identifier added.
+func successor(v Version) Version {
+	if v.Label == "" {
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1, Label: "0"}
+	}
+	return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch, Label: v.Label + ".0"}
+}
+
+// lowest is the lowest version within the range, ok is false if there is no minimum
+func (r Range) lowest() (v Version, ok bool) {
+	switch {
+	case r.NoMinimum:
+		return v, false
+	case r.MinInclusive:
+		return r.Minimum, true
+	default:
+		return successor(r.Minimum), true
+	}
+}
+
+// compareMin orders ranges by their minimum, no minimum first
+func compareMin(a, b Range) int {
+	av, aok := a.lowest()
+	bv, bok := b.lowest()
+	switch {
+	case !aok && !bok:
+		return 0
+	case !aok:
+		return -1
+	case !bok:
+		return 1
+	}
+	return av.Compare(bv)
+}
+
+// compareMax orders ranges by their maximum, no maximum last
+func compareMax(a, b Range) int {
+	switch {
+	case a.NoMaximum && b.NoMaximum:
+		return 0
+	case a.NoMaximum:
+		return 1
+	case b.NoMaximum:
+		return -1
+	}
+	if c := a.Maximum.Compare(b.Maximum); c != 0 {
+		return c
+	}
+	switch {
+	case a.MaxInclusive == b.MaxInclusive:
+		return 0
+	case a.MaxInclusive:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// IsEmpty returns true if no version can fall within the range
+func (r Range) IsEmpty() bool {
+	min, ok := r.lowest()
+	if !ok || r.NoMaximum {
+		return false
+	}
+	c := min.Compare(r.Maximum)
+	return c > 0 || (c == 0 && !r.MaxInclusive)
+}
+
+// Intersect returns the range of versions within both ranges.
+// The result is empty, see IsEmpty, if the ranges do not overlap.
+func (r Range) Intersect(o Range) Range {
+	var i = r
+
+	if compareMin(o, r) > 0 {
+		i.Minimum, i.MinInclusive, i.NoMinimum = o.Minimum, o.MinInclusive, o.NoMinimum
+	}
+	if compareMax(o, r) < 0 {
+		i.Maximum, i.MaxInclusive, i.NoMaximum = o.Maximum, o.MaxInclusive, o.NoMaximum
+	}
+
+	return i
+}
+
+// Overlaps returns true if at least one version falls within both ranges
+func (r Range) Overlaps(o Range) bool {
+	return !r.Intersect(o).IsEmpty()
+}
+
+// Contains returns true if every version within o is also within r.
+// An empty range is contained by every range.
+func (r Range) Contains(o Range) bool {
+	if o.IsEmpty() {
+		return true
+	}
+	return compareMin(r, o) <= 0 && compareMax(r, o) >= 0
+}
+
+// Union returns the versions within either range. If the ranges overlap or are adjacent,
+// with no version between them, the result is a single Range. Otherwise it is a *RangeSet
+// holding both ranges, the lower one first.
+func (r Range) Union(o Range) Constraint {
+	switch {
+	case o.IsEmpty():
+		return r
+	case r.IsEmpty():
+		return o
+	}
+
+	lower, upper := r, o
+	if compareMin(o, r) < 0 {
+		lower, upper = o, r
+	}
+
+	// The versions between the two ranges, if any
+	gap := Range{
+		Minimum:      lower.Maximum,
+		MinInclusive: !lower.MaxInclusive,
+		NoMinimum:    lower.NoMaximum,
+		Maximum:      upper.Minimum,
+		MaxInclusive: !upper.MinInclusive,
+		NoMaximum:    upper.NoMinimum,
+	}
+	if !lower.NoMaximum && !upper.NoMinimum && !gap.IsEmpty() {
+		return &RangeSet{Ranges: []Range{lower, upper}}
+	}
+
+	var u = lower
+	if compareMax(upper, lower) > 0 {
+		u.Maximum, u.MaxInclusive, u.NoMaximum = upper.Maximum, upper.MaxInclusive, upper.NoMaximum
+	}
+	return u
+}
@@ -0,0 +1,129 @@
+package plugin_test
+
+import (
+	"testing"
+
+	"github.com/rovarghe/mule/plugin"
+)
+
+func mustRange(t *testing.T, s string) plugin.Range {
+	r, err := plugin.ParseRange(s)
+	if err != nil {
+		t.Fatal(s, err)
+	}
+	return *r
+}
+
+func TestRangeIsEmpty(t *testing.T) {
+	var table = []struct {
+		r     plugin.Range
+		empty bool
+	}{
+		{mustRange(t, "[1.0.0,1.0.0]"), false},
+		{mustRange(t, "[1.0.0,2.0.0)"), false},
+		{mustRange(t, "(1.0.0,1.0.1)"), false}, // 1.0.1-alpha is within
+		{mustRange(t, "(1.0.0,1.0.1-0)"), true},
+		{mustRange(t, "(1.0.0-alpha,1.0.0-alpha.0)"), true},
+		{mustRange(t, "[1.0.0,)"), false},
+		{plugin.Range{Minimum: plugin.Version{Major: 1}, Maximum: plugin.Version{Major: 1}, MinInclusive: true}, true},
+		{plugin.Range{Minimum: plugin.Version{Major: 2}, Maximum: plugin.Version{Major: 1}, MinInclusive: true, MaxInclusive: true}, true},
+	}
+
+	for _, r := range table {
+		if r.r.IsEmpty() != r.empty {
+			t.Error("IsEmpty of", r.r.String(), "expected", r.empty)
+		}
+	}
+}
+
+func TestRangeIntersect(t *testing.T) {
+	var table = []struct {
+		a, b, intersection string
+	}{
+		{"[1.0.0,2.0.0-beta)", "(1.0.0,1.0.2]", "(1.0.0,1.0.2]"},
+		{"[1.0.0,2.0.0)", "[1.5.0,3.0.0]", "[1.5.0,2.0.0)"},
+		{"[1.0.0,2.0.0]", "[2.0.0,3.0.0]", "[2.0.0,2.0.0]"},
+		{"[1.0.0,2.0.0)", "(1.0.0,2.0.0]", "(1.0.0,2.0.0)"},
+		{"[1.0.0,)", "(,2.0.0)", "[1.0.0,2.0.0)"},
+		{"(,)", "[1.0.0,1.0.0]", "[1.0.0,1.0.0]"},
+	}
+
+	for _, r := range table {
+		a, b := mustRange(t, r.a), mustRange(t, r.b)
+		for _, i := range []plugin.Range{a.Intersect(b), b.Intersect(a)} {
+			if i.String() != r.intersection {
+				t.Error("Intersection of", r.a, "and", r.b, "expected", r.intersection, "got", i.String())
+			}
+		}
+		if !a.Overlaps(b) || !b.Overlaps(a) {
+			t.Error(r.a, "should overlap", r.b)
+		}
+	}
+
+	var disjoint = [][2]string{
+		{"[1.0.0,2.0.0)", "[2.0.0,3.0.0]"},
+		{"[1.0.0,2.0.0]", "(2.0.0,3.0.0]"},
+		{"[1.0.0,2.0.0-beta)", "[2.0.0-beta,2.0.0]"},
+		{"(,1.0.0)", "[1.0.0,)"},
+	}
+	for _, r := range disjoint {
+		a, b := mustRange(t, r[0]), mustRange(t, r[1])
+		if a.Overlaps(b) || b.Overlaps(a) || !a.Intersect(b).IsEmpty() {
+			t.Error(r[0], "should not overlap", r[1])
+		}
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	var table = []struct {
+		a, b     string
+		contains bool
+	}{
+		{"[1.0.0,2.0.0)", "[1.0.0,2.0.0)", true},
+		{"[1.0.0,2.0.0)", "(1.0.0,2.0.0)", true},
+		{"(1.0.0,2.0.0)", "[1.0.0,2.0.0)", false},
+		{"[1.0.0,2.0.0)", "[1.5.0,2.0.0]", false},
+		{"[1.0.0,)", "[1.5.0,9.0.0]", true},
+		{"[1.0.0,9.0.0]", "[1.5.0,)", false},
+		{"[1.0.1-0,2.0.0)", "(1.0.0,2.0.0)", true},
+		{"(1.0.0,2.0.0)", "[1.0.1-0,2.0.0)", true},
+		{"[1.0.0,2.0.0)", "[2.0.0-alpha,2.0.0-beta]", true},
+	}
+
+	for _, r := range table {
+		if mustRange(t, r.a).Contains(mustRange(t, r.b)) != r.contains {
+			t.Error(r.a, "contains", r.b, "expected", r.contains)
+		}
+	}
+
+	empty := plugin.Range{Minimum: plugin.Version{Major: 5}, Maximum: plugin.Version{Major: 5}}
+	if !mustRange(t, "[1.0.0,1.0.0]").Contains(empty) {
+		t.Error("Every range contains the empty range")
+	}
+}
+
+func TestRangeUnion(t *testing.T) {
+	var table = []struct {
+		a, b, union string
+	}{
+		{"[1.0.0,2.0.0)", "[1.5.0,3.0.0]", "[1.0.0,3.0.0]"},
+		{"[1.0.0,2.0.0)", "[2.0.0,3.0.0]", "[1.0.0,3.0.0]"},
+		{"[1.0.0,2.0.0]", "(2.0.0,3.0.0]", "[1.0.0,3.0.0]"},
+		{"[1.0.0,1.0.0]", "(1.0.0,1.0.1)", "[1.0.0,1.0.1)"},
+		{"[1.0.0,1.0.0]", "[1.0.1-0,1.0.1]", "[1.0.0,1.0.1]"},
+		{"[1.0.0,2.0.0)", "(2.0.0,3.0.0]", "[1.0.0,2.0.0) || (2.0.0,3.0.0]"},
+		{"[3.0.0,4.0.0)", "[1.0.0,2.0.0)", "[1.0.0,2.0.0) || [3.0.0,4.0.0)"},
+		{"[1.0.0,)", "(,0.5.0]", "(,0.5.0] || [1.0.0,)"},
+		{"[1.0.0,)", "(,1.0.0)", "(,)"},
+		{"[1.0.0,5.0.0]", "[2.0.0,3.0.0]", "[1.0.0,5.0.0]"},
+	}
+
+	for _, r := range table {
+		a, b := mustRange(t, r.a), mustRange(t, r.b)
+		for _, u := range []plugin.Constraint{a.Union(b), b.Union(a)} {
+			if u.String() != r.union {
+				t.Error("Union of", r.a, "and", r.b, "expected", r.union, "got", u.String())
+			}
+		}
+	}
+}
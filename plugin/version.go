@@ -3,19 +3,27 @@ package plugin
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
-//Version has components Major, Minor and Patch which are numbers followed by an optional hyphen and label
-//1.2.3-alpha, 1.2.3-pre-alpha, 0.1.1-build-13013-alpha, etc
+// Version has components Major, Minor and Patch which are numbers followed by an optional hyphen and label,
+// and optional build metadata after a plus sign.
+// 1.2.3-alpha, 1.2.3-pre-alpha, 0.1.1-build-13013-alpha, 1.2.3-rc.1+exp.sha.5114f85 etc
+// Versions are ordered as defined by Semantic Versioning 2.0, build metadata is not part of the order.
 type Version struct {
 	Major int
 	Minor int
 	Patch int
 	Label string
+	Build string
 }
 
+var semverRegexp = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+	`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
 // Compare one version to another
 func (v Version) Compare(other Version) int {
 	switch {
@@ -36,20 +44,69 @@ func (v Version) Compare(other Version) int {
 			case v.Patch > other.Patch:
 				return 1
 			default:
-				return strings.Compare(v.Label, other.Label)
+				return compareLabels(v.Label, other.Label)
 			}
 		}
 
 	}
 }
 
+// compareLabels orders pre-release labels. A version without a label is greater than one with a label.
+// Labels are compared one dot separated identifier at a time, numerically if both are numbers,
+// otherwise in ASCII order. Numbers come before other identifiers, and a label that is a prefix of
+// another comes first.
+func compareLabels(l, o string) int {
+	switch {
+	case l == o:
+		return 0
+	case l == "":
+		return 1
+	case o == "":
+		return -1
+	}
+
+	li, oi := strings.Split(l, "."), strings.Split(o, ".")
+	for i := 0; i < len(li) && i < len(oi); i++ {
+		ln, lerr := strconv.ParseUint(li[i], 10, 64)
+		on, oerr := strconv.ParseUint(oi[i], 10, 64)
+		switch {
+		case lerr == nil && oerr == nil:
+			if ln != on {
+				if ln < on {
+					return -1
+				}
+				return 1
+			}
+		case lerr == nil:
+			return -1
+		case oerr == nil:
+			return 1
+		default:
+			if c := strings.Compare(li[i], oi[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	switch {
+	case len(li) < len(oi):
+		return -1
+	case len(li) > len(oi):
+		return 1
+	}
+	return 0
+}
+
 // String representation of Version
 func (v Version) String() string {
-	if v.Label == "" {
-		return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	str := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Label != "" {
+		str += "-" + v.Label
 	}
-
-	return fmt.Sprintf("%d.%d.%d-%s", v.Major, v.Minor, v.Patch, v.Label)
+	if v.Build != "" {
+		str += "+" + v.Build
+	}
+	return str
 
 }
 
@@ -60,8 +117,14 @@ func (v Version) Equals(o Version) bool {
 
 // ParseVersion takes  a string representation and converts it into a Version type
 // Value of 'error' will be nil if parse is successful
+// Parsing is lenient, missing minor and patch numbers are taken as zero. Use ParseSemver
+// to accept only well formed semantic versions.
 func ParseVersion(s string) (*Version, error) {
 	var v Version
+	if i := strings.Index(s, "+"); i >= 0 {
+		v.Build = s[i+1:]
+		s = s[:i]
+	}
 	i := strings.Index(s, ".")
 	if i < 0 {
 		i = len(s)
@@ -106,28 +169,55 @@ func ParseVersion(s string) (*Version, error) {
 
 }
 
+// ParseSemver converts a string to a Version, accepting only the format defined by
+// Semantic Versioning 2.0, e.g. 1.0.0, 1.0.0-alpha.1, 1.0.0+20130313144700
+// Value of 'error' will be nil if parse is successful
+func ParseSemver(s string) (*Version, error) {
+	m := semverRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("Invalid semantic version '%s'", s)
+	}
+
+	var v = Version{Label: m[4], Build: m[5]}
+	for i, n := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		j, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid semantic version '%s': %s", s, err)
+		}
+		*n = j
+	}
+	return &v, nil
+}
+
 // Range is a representation of a contiguous set of versions
 // The delimiters '[]' and '()' are indicate if the bounds are inclusive or exclusive, respectively
 // Example: (1.0.0,2.0.0] represents all versions above 1.0.0 and below or equal to 2.0.0
+// A bound may be left out to have no minimum or no maximum, e.g. [1.0.0,) or (,2.0.0)
 type Range struct {
 	Minimum      Version
 	Maximum      Version
 	MinInclusive bool
 	MaxInclusive bool
+	NoMinimum    bool
+	NoMaximum    bool
 }
 
 // String representation of Range
-func (r *Range) String() string {
+func (r Range) String() string {
 	str := ""
-	if r.MinInclusive {
+	if r.MinInclusive && !r.NoMinimum {
 		str += "["
 	} else {
 		str += "("
 	}
-	str += r.Minimum.String()
+	if !r.NoMinimum {
+		str += r.Minimum.String()
+	}
 	str += ","
-	str += r.Maximum.String()
-	if r.MaxInclusive {
+	if !r.NoMaximum {
+		str += r.Maximum.String()
+	}
+	if r.MaxInclusive && !r.NoMaximum {
 		str += "]"
 	} else {
 		str += ")"
@@ -136,18 +226,16 @@ func (r *Range) String() string {
 
 }
 
+// Allows returns true if Version falls within the range, so that a Range can be used as a Constraint
+func (r Range) Allows(v Version) bool {
+	return v.IsWithin(r)
+}
+
 // IsWithin returns true if Version falls within the range specified
 func (v Version) IsWithin(r Range) bool {
-	switch {
-	case r.MinInclusive && r.MaxInclusive:
-		return v.Compare(r.Minimum) >= 0 && v.Compare(r.Maximum) <= 0
-	case r.MinInclusive && !r.MaxInclusive:
-		return v.Compare(r.Minimum) >= 0 && v.Compare(r.Maximum) < 0
-	case !r.MinInclusive && r.MaxInclusive:
-		return v.Compare(r.Minimum) > 0 && v.Compare(r.Maximum) <= 0
-	default: //!d.MinInclusive && !d.MaxInclusive
-		return v.Compare(r.Minimum) > 0 && v.Compare(r.Maximum) < 0
-	}
+	aboveMin := r.NoMinimum || v.Compare(r.Minimum) > 0 || (r.MinInclusive && v.Compare(r.Minimum) == 0)
+	belowMax := r.NoMaximum || v.Compare(r.Maximum) < 0 || (r.MaxInclusive && v.Compare(r.Maximum) == 0)
+	return aboveMin && belowMax
 }
 
 // ParseRange converts a string representation to a Range.
@@ -155,6 +243,10 @@ func (v Version) IsWithin(r Range) bool {
 func ParseRange(s string) (*Range, error) {
 	var r Range
 
+	if len(s) < 2 {
+		return nil, errors.New("Range missing [ or (")
+	}
+
 	switch s[0] {
 	case '[':
 		r.MinInclusive = true
@@ -167,13 +259,17 @@ func ParseRange(s string) (*Range, error) {
 	if i := strings.Index(s, ","); i < 0 {
 		return nil, errors.New("Range missing ,")
 	} else {
-		if v, err := ParseVersion(s[:i]); err != nil {
+		if min := strings.TrimSpace(s[:i]); min == "" {
+			r.NoMinimum = true
+		} else if v, err := ParseVersion(min); err != nil {
 			return nil, err
 		} else {
 			r.Minimum = *v
 		}
 
-		if v, err := ParseVersion(s[i+1 : len(s)-1]); err != nil {
+		if max := strings.TrimSpace(s[i+1 : len(s)-1]); max == "" {
+			r.NoMaximum = true
+		} else if v, err := ParseVersion(max); err != nil {
 			return nil, err
 		} else {
 			r.Maximum = *v
@@ -189,6 +285,10 @@ func ParseRange(s string) (*Range, error) {
 
 	}
 
+	if r.NoMinimum || r.NoMaximum {
+		return &r, nil
+	}
+
 	// Validate range
 	switch r.Minimum.Compare(r.Maximum) {
 	case 1:
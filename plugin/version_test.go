@@ -34,11 +34,13 @@ func TestParseVersion(t *testing.T) {
 		v plugin.Version
 		s string
 	}{
-		{plugin.Version{1, 0, 0, ""}, "1.0.0"},
-		{plugin.Version{1, 0, 1, ""}, "1.0.1"},
-		{plugin.Version{1, 0, 0, ""}, "1"},
-		{plugin.Version{2, 0, 1, "beta"}, "2.0.1-beta"},
-		{plugin.Version{2, 0, 1, "beta.012312"}, "2.0.1-beta.012312"},
+		{plugin.Version{Major: 1, Minor: 0, Patch: 0}, "1.0.0"},
+		{plugin.Version{Major: 1, Minor: 0, Patch: 1}, "1.0.1"},
+		{plugin.Version{Major: 1, Minor: 0, Patch: 0}, "1"},
+		{plugin.Version{Major: 2, Minor: 0, Patch: 1, Label: "beta"}, "2.0.1-beta"},
+		{plugin.Version{Major: 2, Minor: 0, Patch: 1, Label: "beta.012312"}, "2.0.1-beta.012312"},
+		{plugin.Version{Major: 2, Minor: 0, Patch: 1, Label: "beta", Build: "exp.sha"}, "2.0.1-beta+exp.sha"},
+		{plugin.Version{Major: 2, Minor: 0, Patch: 1, Build: "20130313"}, "2.0.1+20130313"},
 	}
 
 	for _, r := range table {
@@ -52,9 +54,9 @@ func TestParseVersion(t *testing.T) {
 		t.Error(e)
 	}
 	switch {
-	case v.Maximum.Compare(plugin.Version{1, 2, 3, ""}) != 0:
+	case v.Maximum.Compare(plugin.Version{Major: 1, Minor: 2, Patch: 3}) != 0:
 		t.Error("Max version range parse error")
-	case v.Minimum.Compare(plugin.Version{1, 2, 3, ""}) != 0:
+	case v.Minimum.Compare(plugin.Version{Major: 1, Minor: 2, Patch: 3}) != 0:
 		t.Error("Min version range parse error")
 	case v.MaxInclusive != true:
 		t.Error("Max inclusive parse error")
@@ -63,3 +65,91 @@ func TestParseVersion(t *testing.T) {
 	}
 
 }
+
+func TestParseSemver(t *testing.T) {
+	var valid = []struct {
+		s string
+		v plugin.Version
+	}{
+		{"0.0.4", plugin.Version{Major: 0, Minor: 0, Patch: 4}},
+		{"1.2.3", plugin.Version{Major: 1, Minor: 2, Patch: 3}},
+		{"10.20.30", plugin.Version{Major: 10, Minor: 20, Patch: 30}},
+		{"1.1.2-prerelease+meta", plugin.Version{Major: 1, Minor: 1, Patch: 2, Label: "prerelease", Build: "meta"}},
+		{"1.1.2+meta", plugin.Version{Major: 1, Minor: 1, Patch: 2, Build: "meta"}},
+		{"1.1.2+meta-valid", plugin.Version{Major: 1, Minor: 1, Patch: 2, Build: "meta-valid"}},
+		{"1.0.0-alpha", plugin.Version{Major: 1, Label: "alpha"}},
+		{"1.0.0-alpha.beta.1", plugin.Version{Major: 1, Label: "alpha.beta.1"}},
+		{"1.0.0-alpha.0valid", plugin.Version{Major: 1, Label: "alpha.0valid"}},
+		{"1.0.0-alpha-a.b-c-somethinglong+build.1-aef.1-its-okay", plugin.Version{Major: 1, Label: "alpha-a.b-c-somethinglong", Build: "build.1-aef.1-its-okay"}},
+		{"1.0.0-rc.1+build.1", plugin.Version{Major: 1, Label: "rc.1", Build: "build.1"}},
+		{"2.0.0-rc.1+build.123", plugin.Version{Major: 2, Label: "rc.1", Build: "build.123"}},
+		{"1.2.3-beta", plugin.Version{Major: 1, Minor: 2, Patch: 3, Label: "beta"}},
+		{"10.2.3-DEV-SNAPSHOT", plugin.Version{Major: 10, Minor: 2, Patch: 3, Label: "DEV-SNAPSHOT"}},
+		{"1.2.3-SNAPSHOT-123", plugin.Version{Major: 1, Minor: 2, Patch: 3, Label: "SNAPSHOT-123"}},
+		{"2.0.1-alpha.1227", plugin.Version{Major: 2, Patch: 1, Label: "alpha.1227"}},
+		{"1.0.0-0A.is.legal", plugin.Version{Major: 1, Label: "0A.is.legal"}},
+		{"1.2.3----RC-SNAPSHOT.12.9.1--.12+788", plugin.Version{Major: 1, Minor: 2, Patch: 3, Label: "---RC-SNAPSHOT.12.9.1--.12", Build: "788"}},
+	}
+
+	for _, r := range valid {
+		v, err := plugin.ParseSemver(r.s)
+		if err != nil || *v != r.v {
+			t.Error("Failed for", r.s, err, v)
+			continue
+		}
+		if v.String() != r.s {
+			t.Error("String representation error, expecting", r.s, "got", v.String())
+		}
+	}
+
+	var invalid = []string{
+		"1", "1.2", "1.2.3-0123", "1.2.3-0123.0123", "1.1.2+.123", "+invalid", "-invalid",
+		"-invalid+invalid", "-invalid.01", "alpha", "alpha.beta", "alpha.1", "alpha+beta",
+		"1.0.0-alpha_beta", "1.0.0-alpha..", "1.0.0-alpha..1", "01.1.1", "1.01.1", "1.1.01",
+		"1.2.3.DEV", "1.2-SNAPSHOT", "1.2.31.2.3----RC-SNAPSHOT.12.09.1--..12+788", "+justmeta",
+		"9.8.7+meta+meta", "9.8.7-whatever+meta+meta", "1.2.3-beta+", "99999999999999999999999.999999999999999999.99999999999999999",
+	}
+
+	for _, s := range invalid {
+		if v, err := plugin.ParseSemver(s); err == nil {
+			t.Error("Expecting error for", s, "got", v)
+		}
+	}
+}
+
+func TestSemverPrecedence(t *testing.T) {
+	// In increasing order of precedence
+	var ordered = []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2",
+		"1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "2.0.0-beta", "2.0.0", "2.1.0", "2.1.1",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			vi, _ := plugin.ParseSemver(ordered[i])
+			vj, _ := plugin.ParseSemver(ordered[j])
+			expected := 0
+			switch {
+			case i < j:
+				expected = -1
+			case i > j:
+				expected = 1
+			}
+			if c := vi.Compare(*vj); c != expected {
+				t.Error("Comparing", ordered[i], "to", ordered[j], "expected", expected, "got", c)
+			}
+		}
+	}
+
+	// Build metadata does not take part in precedence
+	a, _ := plugin.ParseSemver("1.0.0+build.1")
+	b, _ := plugin.ParseSemver("1.0.0+build.2")
+	if !a.Equals(*b) {
+		t.Error("Build metadata should be ignored in comparisons")
+	}
+
+	r, _ := plugin.ParseRange("[1.0.0,2.0.0)")
+	if pre, _ := plugin.ParseSemver("2.0.0-beta"); !pre.IsWithin(*r) {
+		t.Error("2.0.0-beta should be within", r.String())
+	}
+}
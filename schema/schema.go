@@ -3,6 +3,7 @@ package schema
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/rovarghe/mule/plugin"
 )
@@ -42,8 +43,12 @@ type (
 		Get(PathSpec) Router
 	}
 
+	// BaseRouters gives a module the routers of the modules it depends on.
+	// Get panics if id is not a dependency, or is an optional dependency that is not present.
+	// Lookup reports false instead for an optional dependency that is not present.
 	BaseRouters interface {
 		Get(id plugin.ID) Routers
+		Lookup(id plugin.ID) (Routers, bool)
 	}
 
 	Starter interface {
@@ -64,6 +69,13 @@ type (
 		Stopper Stopper
 	}
 
+	// HTTPError can be returned by a StateReducer or RenderReducer to choose the
+	// status code of the response. Message defaults to the standard status text.
+	HTTPError struct {
+		Code    int
+		Message string
+	}
+
 	// moduleContextKeyType string
 
 	// ModuleContext interface {
@@ -91,3 +103,53 @@ func (f StarterFunc) Start(c context.Context, b BaseRouters) (context.Context, e
 func (f StopperFunc) Stop(c context.Context) (context.Context, error) {
 	return f(c)
 }
+
+// Conflicts passes on the conflicts of the plugin, if it is a plugin.Conflicter, so that the
+// loader sees them on the Module
+func (m Module) Conflicts() []plugin.Dependency {
+	return plugin.ConflictsOf(m.Plugin)
+}
+
+// Replaces passes on the plugins the plugin replaces, if it is a plugin.Replacer
+func (m Module) Replaces() []plugin.Dependency {
+	return plugin.ReplacesOf(m.Plugin)
+}
+
+// Provides passes on the capabilities of the plugin, if it is a plugin.Provider
+func (m Module) Provides() []plugin.Capability {
+	return plugin.ProvidesOf(m.Plugin)
+}
+
+// StartTimeout passes on the start timeout of the plugin, if it is plugin.Timed, so that
+// the loader sees it on the Module
+func (m Module) StartTimeout() time.Duration {
+	if t, ok := m.Plugin.(plugin.Timed); ok {
+		return t.StartTimeout()
+	}
+	return 0
+}
+
+// StopTimeout passes on the stop timeout of the plugin, if it is plugin.Timed
+func (m Module) StopTimeout() time.Duration {
+	if t, ok := m.Plugin.(plugin.Timed); ok {
+		return t.StopTimeout()
+	}
+	return 0
+}
+
+// LoadModule reads the plugin manifest at path, see plugin.LoadManifest, and binds it to
+// the Go code that starts and stops the module. Either of starter and stopper may be nil.
+func LoadModule(path string, starter Starter, stopper Stopper) (Module, error) {
+	p, err := plugin.LoadManifest(path)
+	if err != nil {
+		return Module{}, err
+	}
+	return Module{Plugin: p, Starter: starter, Stopper: stopper}, nil
+}
+
+func (e HTTPError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.Code)
+	}
+	return e.Message
+}
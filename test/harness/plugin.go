@@ -2,12 +2,12 @@ package harness
 
 import "github.com/rovarghe/mule/plugin"
 
-var V1_0_0 = plugin.Version{1, 0, 0, ""}
-var V1_0_0copy = plugin.Version{1, 0, 0, ""}
-var V1_0_1 = plugin.Version{1, 0, 1, ""}
-var V1_0_2 = plugin.Version{1, 0, 2, ""}
-var V2_0_0rel = plugin.Version{2, 0, 0, "rel"}
-var V2_0_0beta = plugin.Version{2, 0, 0, "beta"}
+var V1_0_0 = plugin.Version{Major: 1, Minor: 0, Patch: 0}
+var V1_0_0copy = plugin.Version{Major: 1, Minor: 0, Patch: 0}
+var V1_0_1 = plugin.Version{Major: 1, Minor: 0, Patch: 1}
+var V1_0_2 = plugin.Version{Major: 1, Minor: 0, Patch: 2}
+var V2_0_0rel = plugin.Version{Major: 2, Minor: 0, Patch: 0, Label: "rel"}
+var V2_0_0beta = plugin.Version{Major: 2, Minor: 0, Patch: 0, Label: "beta"}
 
 /*
 var provider0 = plugin.Provider{